@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+const usage = `usage: niceconf <command> [flags] [args]
+
+commands:
+  genkey                 print a new base64 AES-256 key
+  encrypt [value]        encrypt a value into ENC(...) form
+  decrypt [value]        decrypt an ENC(...) value
+  dump <dir>             print the merged config of an env dir, secrets masked
+  diff <dir> <dir>       diff two env dirs, use dir@rev to read a git revision
+  lint <dir>             report keys no registered config struct consumes
+  schema <name>          print the JSON Schema of a builtin config file, e.g. mysql_map
+  validate <dir>         check the toml files of an env dir against their schema
+
+the key is read from $NICE_CONF_KEY, $NICE_CONF_KEY_FILE or -key-file.
+the value is read from stdin when not given as argument.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "genkey":
+		err = runGenKey()
+	case "encrypt":
+		err = runCrypt(os.Args[2:], true)
+	case "decrypt":
+		err = runCrypt(os.Args[2:], false)
+	case "dump":
+		err = runDump(os.Args[2:])
+	case "diff":
+		err = runDiff(os.Args[2:])
+	case "lint":
+		err = runLint(os.Args[2:])
+	case "schema":
+		err = runSchema(os.Args[2:])
+	case "validate":
+		err = runValidate(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "niceconf:", err)
+		os.Exit(1)
+	}
+}
+
+func runGenKey() error {
+	key, err := lib.NewConfKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+func runCrypt(args []string, encrypt bool) error {
+	fs := flag.NewFlagSet("niceconf", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "file holding the base64 key")
+	fs.Parse(args)
+
+	if *keyFile != "" {
+		os.Setenv(lib.ConfKeyFileEnv, *keyFile)
+		os.Unsetenv(lib.ConfKeyEnv)
+	}
+	key, err := lib.LoadConfKey()
+	if err != nil {
+		return err
+	}
+	value := strings.Join(fs.Args(), " ")
+	if value == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		value = strings.TrimRight(line, "\r\n")
+	}
+	var out string
+	if encrypt {
+		out, err = lib.EncryptConfValue(key, value)
+	} else {
+		out, err = lib.DecryptConfValue(key, value)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(out)
+	return nil
+}
+
+func runDump(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: niceconf dump <dir>")
+	}
+	dump, err := loadDump(args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(dump)
+}
+
+func runDiff(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: niceconf diff <dir> <dir>")
+	}
+	old, err := loadDump(args[0])
+	if err != nil {
+		return err
+	}
+	new, err := loadDump(args[1])
+	if err != nil {
+		return err
+	}
+	for _, diff := range lib.DiffConf(old, new) {
+		switch {
+		case diff.Old == nil:
+			fmt.Printf("+ %s = %v\n", diff.Key, diff.New)
+		case diff.New == nil:
+			fmt.Printf("- %s = %v\n", diff.Key, diff.Old)
+		default:
+			fmt.Printf("~ %s = %v -> %v\n", diff.Key, diff.Old, diff.New)
+		}
+	}
+	return nil
+}
+
+func runLint(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: niceconf lint <dir>")
+	}
+	snapshot, err := loadSnapshot(args[0])
+	if err != nil {
+		return err
+	}
+	issues, err := lib.LintConfSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%d lint issues", len(issues))
+	}
+	return nil
+}
+
+func runSchema(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: niceconf schema <name>")
+	}
+	schema, err := lib.ConfJSONSchema(args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(schema)
+}
+
+func runValidate(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: niceconf validate <dir>")
+	}
+	snapshot, err := loadSnapshot(args[0])
+	if err != nil {
+		return err
+	}
+	errs, err := lib.ValidateConfSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	for _, e := range errs {
+		fmt.Println(e)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d validation errors", len(errs))
+	}
+	return nil
+}
+
+func loadDump(arg string) (map[string]interface{}, error) {
+	snapshot, err := loadSnapshot(arg)
+	if err != nil {
+		return nil, err
+	}
+	return lib.DumpConfSnapshot(snapshot)
+}
+
+// 读取配置目录,dir@rev 形式从git历史版本读取
+func loadSnapshot(arg string) (map[string][]byte, error) {
+	dir, rev, ok := strings.Cut(arg, "@")
+	if !ok {
+		return lib.NewFileProvider(dir).Load(context.Background())
+	}
+	dir = strings.TrimSuffix(path.Clean(dir), "/")
+	out, err := exec.Command("git", "ls-tree", "--name-only", rev, dir+"/").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-tree %s %s:%v", rev, dir, err)
+	}
+	snapshot := make(map[string][]byte)
+	for _, file := range strings.Fields(string(out)) {
+		if !strings.HasSuffix(file, ".toml") {
+			continue
+		}
+		data, err := exec.Command("git", "show", rev+":./"+file).Output()
+		if err != nil {
+			return nil, fmt.Errorf("git show %s:%s:%v", rev, file, err)
+		}
+		snapshot[path.Base(file)] = data
+	}
+	return snapshot, nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
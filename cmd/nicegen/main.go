@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	_ "github.com/m17621679833/nice_base/lib/driver/postgres"
+	_ "github.com/m17621679833/nice_base/lib/driver/sqlite"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `usage: nicegen <command> [flags]
+
+commands:
+  model -config <dir> [-pool name] [-out dir] [-pkg name] [-tables a,b_*] [-exclude c]
+                         generate gorm models from the tables of a db pool in mysql_map.toml
+
+existing files are merged: the generated struct and TableName are replaced,
+other declarations in the file are kept.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "model":
+		err = runModel(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "nicegen:", err)
+		os.Exit(1)
+	}
+}
+
+func runModel(args []string) error {
+	fs := flag.NewFlagSet("nicegen model", flag.ExitOnError)
+	pool := fs.String("pool", "default", "db pool name in mysql_map.toml")
+	out := fs.String("out", "./model", "output dir, one file per table")
+	pkg := fs.String("pkg", "", "package name, default the base name of -out")
+	tables := fs.String("tables", "", "comma separated table names or globs, default all tables")
+	exclude := fs.String("exclude", "", "comma separated table names or globs to skip")
+	app := lib.New(lib.WithFlagSet(fs), lib.WithModulePolicy("mysql", lib.PolicyRequired))
+	fs.Parse(args)
+	if *pkg == "" {
+		abs, err := filepath.Abs(*out)
+		if err != nil {
+			return err
+		}
+		*pkg = filepath.Base(abs)
+	}
+
+	if err := app.InitModule([]string{"mysql"}); err != nil {
+		return err
+	}
+	defer app.Destroy()
+	list, err := app.LoadModelTables(context.Background(), *pool, splitList(*tables), splitList(*exclude))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+	for _, table := range list {
+		generated, err := lib.GenerateModel(*pkg, table)
+		if err != nil {
+			return fmt.Errorf("%v:%w", table.Name, err)
+		}
+		file := filepath.Join(*out, table.Name+".go")
+		existing, err := os.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		merged, err := lib.MergeModelSource(existing, generated)
+		if err != nil {
+			return fmt.Errorf("%v:%w", file, err)
+		}
+		if err := os.WriteFile(file, merged, 0644); err != nil {
+			return err
+		}
+		fmt.Println(file)
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	_ "github.com/m17621679833/nice_base/lib/driver/postgres"
+	_ "github.com/m17621679833/nice_base/lib/driver/sqlite"
+	"os"
+)
+
+const usage = `usage: nicemigrate -config <dir> -dir <migrations dir> [-pool name] <command> [flags]
+
+commands:
+  up                     apply all pending migrations
+  down [-steps n]        roll back the last n applied migrations, default 1
+  status                 list migrations with their applied time
+
+migration files are named <version>_<name>.up.sql and <version>_<name>.down.sql.
+migrations written as Go funcs must be run from the service binary via lib.RunMigrateCommand.
+`
+
+func main() {
+	fs := flag.NewFlagSet("nicemigrate", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	dir := fs.String("dir", "./migrations", "dir holding the sql migration files")
+	pool := fs.String("pool", "default", "db pool name in mysql_map.toml")
+	app := lib.New(lib.WithFlagSet(fs), lib.WithModulePolicy("mysql", lib.PolicyRequired))
+	fs.Parse(os.Args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(app, *pool, *dir, fs.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "nicemigrate:", err)
+		os.Exit(1)
+	}
+}
+
+// 出错时也要先执行Destroy关闭连接池和日志,os.Exit只在main中调用
+func run(app *lib.App, pool, dir string, args []string) error {
+	if err := app.InitModule([]string{"mysql"}); err != nil {
+		return err
+	}
+	defer app.Destroy()
+	if err := app.LoadMigrations(pool, os.DirFS(dir)); err != nil {
+		return err
+	}
+	cmd := append(args[:1:1], "-pool", pool)
+	return app.RunMigrateCommand(context.Background(), append(cmd, args[1:]...), os.Stdout)
+}
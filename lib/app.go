@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"github.com/m17621679833/nice_base/nlog"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 应用容器,持有配置、连接池、日志和模块生命周期,多个App可在同一进程共存
+type App struct {
+	ConfBase        *BaseConf
+	DBMapPool       map[string]*sql.DB
+	GORMMapPool     map[string]*gorm.DB
+	DBDefaultPool   *sql.DB
+	GORMDefaultPool *gorm.DB
+	ConfRedis       *RedisConf
+	ConfRedisMap    *RedisConfMap
+	ViperConfMap    map[string]*viper.Viper
+	ConfEnvPath     string
+	ConfEnv         string
+	TimeLocation    *time.Location
+	Log             *LoggerFaced
+
+	isDefault        bool
+	logger           *nlog.Logger
+	confLock         sync.RWMutex
+	confProvider     ConfigProvider
+	configPath       string
+	configFlagSet    *flag.FlagSet
+	confSnapshot     map[string][]byte
+	viperConfSecrets map[string][]string
+	dbConfs          map[string]*MysqlConf
+	dbReplicas       map[string]*dbReplicaSet
+	dbShards         map[string]*shardRouter
+	dbGuards         map[string]*dbGuard
+	dbHealth         *dbHealthChecker
+	slowQueries      *slowQueryAggregator
+	dbAudit          *dbAuditor
+	auditWriter      atomic.Pointer[AuditWriter]
+	dbTenants        *tenantRouter
+	tenantResolver   atomic.Pointer[TenantResolver]
+	migrations       migrationRegistry
+	autoMigrate      bool
+
+	moduleLock     sync.Mutex
+	moduleRegistry map[string]Module
+	initedModules  []Module
+	modulePolicies map[string]ModulePolicy
+	moduleStates   map[string]*ModuleStatus
+	retryCtx       context.Context
+	retryCancel    context.CancelFunc
+	retryWg        sync.WaitGroup
+	shutdownHooks  []shutdownHook
+}
+
+type Option func(*App)
+
+// 默认实例,包级函数和全局变量均代理到该实例
+var defaultApp = newApp(true)
+
+func init() {
+	Log = defaultApp.Log
+}
+
+func New(opts ...Option) *App {
+	a := newApp(false)
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+func newApp(isDefault bool) *App {
+	a := &App{
+		Log:            &LoggerFaced{},
+		isDefault:      isDefault,
+		moduleRegistry: map[string]Module{},
+		modulePolicies: map[string]ModulePolicy{"base": PolicyRequired},
+		moduleStates:   map[string]*ModuleStatus{},
+	}
+	a.RegisterModule(&baseModule{app: a})
+	a.RegisterModule(&redisModule{app: a})
+	a.RegisterModule(&mysqlModule{app: a})
+	return a
+}
+
+func Default() *App {
+	return defaultApp
+}
+
+// 配置目录环境变量,优先级高于代码中指定的路径
+const ConfigEnv = "NICE_CONFIG"
+
+// 对默认实例应用选项,供包级InitModule使用
+func Configure(opts ...Option) {
+	for _, opt := range opts {
+		opt(defaultApp)
+	}
+}
+
+// 使用本地配置目录,如 ./conf/dev/
+func WithConfigPath(path string) Option {
+	return func(a *App) {
+		a.configPath = path
+	}
+}
+
+// 在调用方的FlagSet上注册 -config,由调用方负责Parse,InitModule时读取
+func WithFlagSet(fs *flag.FlagSet) Option {
+	return func(a *App) {
+		if fs.Lookup("config") == nil {
+			fs.String("config", "", "input config dir like ./conf/dev/")
+		}
+		a.configFlagSet = fs
+	}
+}
+
+func WithConfigProvider(provider ConfigProvider) Option {
+	return func(a *App) {
+		a.ParseConfigPath(provider.Path() + "/")
+		a.confProvider = provider
+	}
+}
+
+func WithModule(m Module) Option {
+	return func(a *App) {
+		a.RegisterModule(m)
+	}
+}
+
+func WithModulePolicy(name string, policy ModulePolicy) Option {
+	return func(a *App) {
+		a.SetModulePolicy(name, policy)
+	}
+}
+
+var errNoConfProvider = errors.New("config source not set, use WithConfigPath, WithConfigProvider, $" + ConfigEnv + " or -config")
+
+// 按依赖顺序初始化模块
+func (a *App) InitModule(modules []string) error {
+	if provider := a.configProvider(); provider != nil {
+		return a.initModule(provider, modules)
+	}
+	return a.initFileModule(a.configPath, modules)
+}
+
+func (a *App) initFileModule(defaultPath string, modules []string) error {
+	path := a.resolveConfigPath(defaultPath)
+	if path == "" {
+		return errNoConfProvider
+	}
+	if err := a.ParseConfigPath(path); err != nil {
+		return err
+	}
+	return a.initModule(NewFileProvider(a.ConfEnvPath), modules)
+}
+
+// 配置目录优先级: -config > $NICE_CONFIG > 代码指定路径
+func (a *App) resolveConfigPath(defaultPath string) string {
+	path := defaultPath
+	if env := os.Getenv(ConfigEnv); env != "" {
+		path = env
+	}
+	if fs := a.configFlagSet; fs != nil && fs.Parsed() {
+		if f := fs.Lookup("config"); f != nil && f.Value.String() != "" {
+			path = f.Value.String()
+		}
+	}
+	if path != "" && !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return path
+}
+
+// 默认实例的状态同步到包级全局变量,兼容旧代码直接读取全局变量
+func (a *App) publish() {
+	if !a.isDefault {
+		return
+	}
+	ConfBase = a.ConfBase
+	DBMapPool = a.DBMapPool
+	GORMMapPool = a.GORMMapPool
+	DBDefaultPool = a.DBDefaultPool
+	GORMDefaultPool = a.GORMDefaultPool
+	ConfRedis = a.ConfRedis
+	ConfRedisMap = a.ConfRedisMap
+	ViperConfMap = a.ViperConfMap
+	ConfEnvPath = a.ConfEnvPath
+	ConfEnv = a.ConfEnv
+	TimeLocation = a.TimeLocation
+	Log = a.Log
+}
@@ -2,15 +2,17 @@ package lib
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/m17621679833/nice_base/nlog"
 	"github.com/spf13/viper"
 	"gorm.io/gorm"
-	"io"
-	"io/ioutil"
+	"io/fs"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -44,31 +46,122 @@ type LogConfConsoleWriter struct {
 }
 
 type LogConfig struct {
-	Level string               `mapstructure:"log_level"`
+	Level string               `mapstructure:"log_level" default:"trace" validate:"oneof=trace debug info warning error fatal"`
 	FW    LogConfFileWriter    `mapstructure:"file_writer"`
 	CW    LogConfConsoleWriter `mapstructure:"console_writer"`
 }
 
 type BaseConf struct {
-	DebugMode    string    `mapstructure:"debug_mode"`
-	TimeLocation string    `mapstructure:"time_location"`
+	DebugMode    string    `mapstructure:"debug_mode" default:"debug" validate:"oneof=debug release test"`
+	TimeLocation string    `mapstructure:"time_location" default:"Asia/Shanghai"`
 	Log          LogConfig `mapstructure:"log"`
 	Base         struct {
-		DebugMode    string `mapstructure:"debug_mode"`
-		TimeLocation string `mapstructure:"time_location"`
+		DebugMode    string `mapstructure:"debug_mode" default:"debug" validate:"oneof=debug release test"`
+		TimeLocation string `mapstructure:"time_location" default:"Asia/Shanghai"`
 	} `mapstructure:"base"`
 }
 
 type MysqlConfMap struct {
-	List map[string]*MysqlConf `mapstructure:"list"`
+	List   map[string]*MysqlConf `mapstructure:"list"`
+	Shards map[string]*ShardConf `mapstructure:"shards"`
+	// 写操作审计,不配置不启用
+	Audit *DBAuditConf `mapstructure:"audit"`
+	// 多租户路由,不配置不启用
+	Tenants *TenantConf `mapstructure:"tenants"`
 }
 
 type MysqlConf struct {
-	DriverName      string `mapstructure:"driver_name"`
-	DataSourceName  string `mapstructure:"data_source_name"`
-	MaxOpenConn     int    `mapstructure:"max_open_conn"`
-	MaxIdleConn     int    `mapstructure:"max_idle_conn"`
-	MaxConnLifeTime int    `mapstructure:"max_conn_life_time"`
+	DriverName      string `mapstructure:"driver_name" default:"mysql"`
+	DataSourceName  string `mapstructure:"data_source_name" validate:"required,min=1"`
+	MaxOpenConn     int    `mapstructure:"max_open_conn" validate:"min=0"`
+	MaxIdleConn     int    `mapstructure:"max_idle_conn" validate:"min=0"`
+	MaxConnLifeTime int    `mapstructure:"max_conn_life_time" validate:"min=0"`
+	// 原生sql查询超时,单位毫秒,0使用DefaultDBQueryTimeout
+	QueryTimeout int `mapstructure:"query_timeout" validate:"min=0"`
+	// gorm日志级别,未配置使用DefaultMysqlGormLogger.LogLevel
+	LogLevel string `mapstructure:"log_level" default:"info" validate:"oneof=silent error warn info"`
+	// 慢查询阈值,单位毫秒,0使用DefaultMysqlGormLogger.SlowThreshold
+	SlowThresholdMs int `mapstructure:"slow_threshold_ms" validate:"min=0"`
+	// 记录不存在是否不记错误日志,未配置使用DefaultMysqlGormLogger.IgnoreRecordNotFoundError
+	IgnoreRecordNotFound *bool `mapstructure:"ignore_record_not_found"`
+	// 日志中的sql保留?占位符,不输出参数值
+	ParameterizedQueries bool `mapstructure:"parameterized_queries"`
+	// 读请求在从库间的负载策略
+	ReplicaPolicy string              `mapstructure:"replica_policy" default:"round_robin" validate:"oneof=round_robin weighted random"`
+	Replicas      []*MysqlReplicaConf `mapstructure:"replicas"`
+	// 等待空闲连接的最长时间,单位毫秒,超时直接失败;0不限制,需同时配置max_open_conn
+	MaxConnWaitMs int `mapstructure:"max_conn_wait_ms" validate:"min=0"`
+	// 熔断配置,不配置不启用
+	Breaker *DBBreakerConf `mapstructure:"breaker"`
+}
+
+// 熔断: 统计窗口内请求数达到min_requests且错误率或慢查询比例超限时打开,open_ms后放行探测请求
+type DBBreakerConf struct {
+	ErrorRate float64 `mapstructure:"error_rate" default:"0.5" validate:"min=0,max=1"`
+	// 慢查询比例,0不按耗时熔断;慢查询阈值取slow_ms,未配置取连接池slow_threshold_ms
+	SlowRate         float64 `mapstructure:"slow_rate" validate:"min=0,max=1"`
+	SlowMs           int     `mapstructure:"slow_ms" validate:"min=0"`
+	MinRequests      int     `mapstructure:"min_requests" default:"20" validate:"min=0"`
+	WindowMs         int     `mapstructure:"window_ms" default:"10000" validate:"min=0"`
+	OpenMs           int     `mapstructure:"open_ms" default:"5000" validate:"min=0"`
+	HalfOpenRequests int     `mapstructure:"half_open_requests" default:"1" validate:"min=0"`
+}
+
+// 审计输出到独立日志文件(log)或审计表(table),image_tables中的表额外记录修改前后的数据
+type DBAuditConf struct {
+	Output string `mapstructure:"output" default:"log" validate:"oneof=log table"`
+	// 审计日志文件,未配置时写入应用日志
+	LogPath       string `mapstructure:"log_path"`
+	RotateLogPath string `mapstructure:"rotate_log_path"`
+	// 审计表所在连接池和表名
+	Pool          string   `mapstructure:"pool" default:"default"`
+	Table         string   `mapstructure:"table" default:"sql_audit_log"`
+	ImageTables   []string `mapstructure:"image_tables"`
+	ExcludeTables []string `mapstructure:"exclude_tables"`
+}
+
+// 租户映射到已有连接池(pool),或按data_source_name/data_source_template懒加载独立连接池
+// 未在list中的租户使用data_source_template,{tenant}替换为租户的schema,未配置schema时为租户id
+type TenantConf struct {
+	// 懒加载连接池的driver、连接池大小、日志、熔断等配置取自该连接池
+	BasePool           string `mapstructure:"base_pool" default:"default"`
+	DataSourceTemplate string `mapstructure:"data_source_template"`
+	// 懒加载的连接池空闲超过该秒数后关闭,未配置时600,0不关闭
+	IdleTimeout *int                       `mapstructure:"idle_timeout" default:"600" validate:"omitempty,min=0"`
+	List        map[string]*TenantNodeConf `mapstructure:"list"`
+}
+
+// pool与schema/data_source_name二选一
+type TenantNodeConf struct {
+	Pool           string `mapstructure:"pool"`
+	Schema         string `mapstructure:"schema"`
+	DataSourceName string `mapstructure:"data_source_name"`
+}
+
+// 从库配置,连接池大小沿用主库配置
+type MysqlReplicaConf struct {
+	DataSourceName string `mapstructure:"data_source_name" validate:"required,min=1"`
+	Weight         int    `mapstructure:"weight" default:"1" validate:"min=0"`
+}
+
+// 逻辑表的分片规则,表名为 table + 后缀,如 orders_00 ~ orders_63
+type ShardConf struct {
+	ShardKey  string `mapstructure:"shard_key" validate:"required,min=1"`
+	Table     string `mapstructure:"table" validate:"required,min=1"`
+	Algorithm string `mapstructure:"algorithm" default:"mod" validate:"oneof=mod hash_range"`
+	// 分表总数,各节点按编号范围认领
+	TableCount int `mapstructure:"table_count" default:"1" validate:"min=1"`
+	// hash_range 的槽位数,每张表认领连续的一段槽位
+	Slots int `mapstructure:"slots" default:"1024" validate:"min=0"`
+	// 表后缀的fmt格式,默认按位数补零如 _%02d,none 表示不加后缀
+	SuffixFormat string           `mapstructure:"suffix_format"`
+	Nodes        []*ShardNodeConf `mapstructure:"nodes" validate:"required,min=1"`
+}
+
+// 分片节点: 连接池名和该池上的分表编号范围,如 "0-31" 或 "7"
+type ShardNodeConf struct {
+	Pool   string `mapstructure:"pool" validate:"required,min=1"`
+	Tables string `mapstructure:"tables" validate:"required,min=1"`
 }
 
 type RedisConfMap struct {
@@ -76,141 +169,168 @@ type RedisConfMap struct {
 }
 
 type RedisConf struct {
-	ProxyList    []string `mapstructure:"proxy_list"`
+	ProxyList    []string `mapstructure:"proxy_list" validate:"required,min=1"`
 	Password     string   `mapstructure:"password"`
-	Db           int      `mapstructure:"db"`
-	ConnTimeout  int      `mapstructure:"conn_timeout"`
-	ReadTimeout  int      `mapstructure:"read_timeout"`
-	WriteTimeout int      `mapstructure:"write_timeout"`
+	Db           int      `mapstructure:"db" validate:"min=0"`
+	ConnTimeout  int      `mapstructure:"conn_timeout" default:"50" validate:"min=0"`
+	ReadTimeout  int      `mapstructure:"read_timeout" default:"100" validate:"min=0"`
+	WriteTimeout int      `mapstructure:"write_timeout" default:"100" validate:"min=0"`
 }
 
 func GetBaseConf() *BaseConf {
-	return ConfBase
+	return defaultApp.GetBaseConf()
+}
+
+func (a *App) GetBaseConf() *BaseConf {
+	return a.ConfBase
 }
 
 func GetStringConf(key string) string {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
-		return ""
-	}
-	v, ok := ViperConfMap[keys[0]]
+	return defaultApp.GetStringConf(key)
+}
+
+func (a *App) GetStringConf(key string) string {
+	v, subKey, ok := a.lookupViperConf(key)
 	if !ok {
 		return ""
 	}
-	confString := v.GetString(strings.Join(keys[1:len(keys)], "."))
-	return confString
+	return v.GetString(subKey)
 }
 
 func GetStringMapConf(key string) map[string]interface{} {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	return defaultApp.GetStringMapConf(key)
+}
+
+func (a *App) GetStringMapConf(key string) map[string]interface{} {
+	v, subKey, ok := a.lookupViperConf(key)
+	if !ok {
 		return nil
 	}
-	v := ViperConfMap[keys[0]]
-	conf := v.GetStringMap(strings.Join(keys[1:len(keys)], "."))
-	return conf
+	return v.GetStringMap(subKey)
 }
 
 func GetConf(key string) interface{} {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	return defaultApp.GetConf(key)
+}
+
+func (a *App) GetConf(key string) interface{} {
+	v, subKey, ok := a.lookupViperConf(key)
+	if !ok {
 		return false
 	}
-	v := ViperConfMap[keys[0]]
-	conf := v.Get(strings.Join(keys[1:len(keys)], "."))
-	return conf
+	return v.Get(subKey)
 }
 
 func GetBoolConf(key string) bool {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	return defaultApp.GetBoolConf(key)
+}
+
+func (a *App) GetBoolConf(key string) bool {
+	v, subKey, ok := a.lookupViperConf(key)
+	if !ok {
 		return false
 	}
-	v := ViperConfMap[keys[0]]
-	conf := v.GetBool(strings.Join(keys[1:len(keys)], "."))
-	return conf
+	return v.GetBool(subKey)
 }
 
 // 获取get配置信息
 func GetFloat64Conf(key string) float64 {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	return defaultApp.GetFloat64Conf(key)
+}
+
+func (a *App) GetFloat64Conf(key string) float64 {
+	v, subKey, ok := a.lookupViperConf(key)
+	if !ok {
 		return 0
 	}
-	v := ViperConfMap[keys[0]]
-	conf := v.GetFloat64(strings.Join(keys[1:len(keys)], "."))
-	return conf
+	return v.GetFloat64(subKey)
 }
 
 // 获取get配置信息
 func GetIntConf(key string) int {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	return defaultApp.GetIntConf(key)
+}
+
+func (a *App) GetIntConf(key string) int {
+	v, subKey, ok := a.lookupViperConf(key)
+	if !ok {
 		return 0
 	}
-	v := ViperConfMap[keys[0]]
-	conf := v.GetInt(strings.Join(keys[1:len(keys)], "."))
-	return conf
+	return v.GetInt(subKey)
 }
 
 // 获取get配置信息
 func GetStringMapStringConf(key string) map[string]string {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	return defaultApp.GetStringMapStringConf(key)
+}
+
+func (a *App) GetStringMapStringConf(key string) map[string]string {
+	v, subKey, ok := a.lookupViperConf(key)
+	if !ok {
 		return nil
 	}
-	v := ViperConfMap[keys[0]]
-	conf := v.GetStringMapString(strings.Join(keys[1:len(keys)], "."))
-	return conf
+	return v.GetStringMapString(subKey)
 }
 
 // 获取get配置信息
 func GetStringSliceConf(key string) []string {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	return defaultApp.GetStringSliceConf(key)
+}
+
+func (a *App) GetStringSliceConf(key string) []string {
+	v, subKey, ok := a.lookupViperConf(key)
+	if !ok {
 		return nil
 	}
-	v := ViperConfMap[keys[0]]
-	conf := v.GetStringSlice(strings.Join(keys[1:len(keys)], "."))
-	return conf
+	return v.GetStringSlice(subKey)
 }
 
 // 获取get配置信息
 func GetTimeConf(key string) time.Time {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	return defaultApp.GetTimeConf(key)
+}
+
+func (a *App) GetTimeConf(key string) time.Time {
+	v, subKey, ok := a.lookupViperConf(key)
+	if !ok {
 		return time.Now()
 	}
-	v := ViperConfMap[keys[0]]
-	conf := v.GetTime(strings.Join(keys[1:len(keys)], "."))
-	return conf
+	return v.GetTime(subKey)
 }
 
 // 获取时间阶段长度
 func GetDurationConf(key string) time.Duration {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	return defaultApp.GetDurationConf(key)
+}
+
+func (a *App) GetDurationConf(key string) time.Duration {
+	v, subKey, ok := a.lookupViperConf(key)
+	if !ok {
 		return 0
 	}
-	v := ViperConfMap[keys[0]]
-	conf := v.GetDuration(strings.Join(keys[1:len(keys)], "."))
-	return conf
+	return v.GetDuration(subKey)
 }
 
 // 是否设置了key
 func IsSetConf(key string) bool {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
+	return defaultApp.IsSetConf(key)
+}
+
+func (a *App) IsSetConf(key string) bool {
+	v, subKey, ok := a.lookupViperConf(key)
+	if !ok {
 		return false
 	}
-	v := ViperConfMap[keys[0]]
-	conf := v.IsSet(strings.Join(keys[1:len(keys)], "."))
-	return conf
+	return v.IsSet(subKey)
 }
 
 func InitBaseConf(path string) error {
+	return defaultApp.InitBaseConf(path)
+}
+
+func (a *App) InitBaseConf(path string) error {
 	confBase := &BaseConf{}
-	err := ParseConfig(path, confBase)
+	err := a.ParseConfig(path, confBase)
 	if err != nil {
 		return err
 	}
@@ -245,76 +365,148 @@ func InitBaseConf(path string) error {
 			Color: confBase.Log.CW.Color,
 		},
 	}
-	err = nlog.SetupDefaultLogWithConf(logConfig)
-	if err != nil {
-		panic(err)
+	if a.isDefault {
+		err = nlog.SetupDefaultLogWithConf(logConfig)
+		if err != nil {
+			panic(err)
+		}
+		nlog.SetLayout("2024-05-10T15:21:23.000")
+	} else {
+		if a.logger != nil {
+			a.logger.Close()
+		}
+		a.logger = nlog.New()
+		err = nlog.SetupLogInstanceWithConf(logConfig, a.logger)
+		if err != nil {
+			panic(err)
+		}
+		a.logger.SetLayout("2024-05-10T15:21:23.000")
+		a.Log.logger = a.logger
 	}
-	nlog.SetLayout("2024-05-10T15:21:23.000")
-	ConfBase = confBase
+	a.ConfBase = confBase
+	a.publish()
 	return nil
 }
 
+// 关闭App的日志,默认实例关闭nlog默认日志
+func (a *App) closeLog() {
+	if a.isDefault {
+		nlog.Close()
+		return
+	}
+	if a.logger != nil {
+		a.logger.Close()
+		a.logger = nil
+		a.Log.logger = nil
+	}
+}
+
 func InitRedisConf(path string) error {
+	return defaultApp.InitRedisConf(path)
+}
+
+func (a *App) InitRedisConf(path string) error {
 	redisConf := &RedisConfMap{}
-	err := ParseConfig(path, redisConf)
+	err := a.ParseConfig(path, redisConf)
 	if err != nil {
 		return err
 	}
-	ConfRedisMap = redisConf
+	a.ConfRedisMap = redisConf
+	a.publish()
 	return nil
 }
 
 func InitViperConf() error {
-	file, err := os.Open(ConfEnvPath + "/")
-	if err != nil {
+	return defaultApp.InitViperConf()
+}
+
+func (a *App) InitViperConf() error {
+	snapshot, err := NewFileProvider(a.ConfEnvPath).Load(context.Background())
+	// 配置目录不存在时不加载,其余读取错误返回
+	if errors.Is(err, fs.ErrNotExist) {
 		return nil
 	}
-	fileList, err := file.ReadDir(1024)
 	if err != nil {
 		return err
 	}
-	for _, innerFile := range fileList {
-		data, err := ioutil.ReadFile(ConfEnvPath + "/" + innerFile.Name())
-		if err != nil {
-			return err
-		}
+	return a.setConfSnapshot(snapshot)
+}
+
+// 用配置源快照重建ViperConfMap
+func (a *App) setConfSnapshot(snapshot map[string][]byte) error {
+	viperMap := make(map[string]*viper.Viper)
+	secretMap := make(map[string][]string)
+	for name, data := range snapshot {
 		v := viper.New()
 		v.SetConfigType("toml")
 		v.ReadConfig(bytes.NewBuffer(data))
-		pathArray := strings.Split(innerFile.Name(), ".")
-		if ViperConfMap == nil {
-			ViperConfMap = make(map[string]*viper.Viper)
+		secrets, err := decryptViperConf(v)
+		if err != nil {
+			return fmt.Errorf("config %v:%v", name, err)
 		}
-		ViperConfMap[pathArray[0]] = v
+		pathArray := strings.Split(name, ".")
+		viperMap[pathArray[0]] = v
+		secretMap[pathArray[0]] = secrets
 	}
+	a.confLock.Lock()
+	a.ViperConfMap = viperMap
+	a.viperConfSecrets = secretMap
+	a.confSnapshot = snapshot
+	a.confLock.Unlock()
+	a.publish()
 	return nil
 }
 
+// 优先从配置源快照读取,不在快照中的文件从磁盘读取
+func (a *App) readConfData(path string) ([]byte, error) {
+	a.confLock.RLock()
+	if a.confSnapshot != nil && filepath.Clean(filepath.Dir(path)) == filepath.Clean(a.ConfEnvPath) {
+		if data, ok := a.confSnapshot[filepath.Base(path)]; ok {
+			a.confLock.RUnlock()
+			return data, nil
+		}
+	}
+	a.confLock.RUnlock()
+	return os.ReadFile(path)
+}
+
 func ParseConfig(path string, conf interface{}) error {
-	file, err := os.Open(path)
+	return defaultApp.ParseConfig(path, conf)
+}
+
+func (a *App) ParseConfig(path string, conf interface{}) error {
+	data, err := a.readConfData(path)
 	if err != nil {
 		return fmt.Errorf("open config %v fail,%v", path, err)
 	}
-	data, err := io.ReadAll(file)
-	if err != nil {
-		return fmt.Errorf("read config error:%v", err)
-	}
 	v := viper.New()
 	v.SetConfigType("toml")
 	v.ReadConfig(bytes.NewBuffer(data))
+	secrets, err := decryptViperConf(v)
+	if err != nil {
+		return fmt.Errorf("config %v:%v", path, err)
+	}
 	if err = v.Unmarshal(conf); err != nil {
-		return fmt.Errorf("unmarshal %v error %v\n", string(data), err)
+		return fmt.Errorf("unmarshal config %v error:%v", path, maskConfSecrets(err.Error(), secrets))
 	}
 	return nil
 }
 
 func GetConfEnv() string {
-	return ConfEnv
+	return defaultApp.GetConfEnv()
+}
+
+func (a *App) GetConfEnv() string {
+	return a.ConfEnv
 }
 
 func ParseLocalConfig(fileName string, conf interface{}) error {
-	path := GetConfFilePath(fileName)
-	err := ParseConfig(path, conf)
+	return defaultApp.ParseLocalConfig(fileName, conf)
+}
+
+func (a *App) ParseLocalConfig(fileName string, conf interface{}) error {
+	path := a.GetConfFilePath(fileName)
+	err := a.ParseConfig(path, conf)
 	if err != nil {
 		return err
 	}
@@ -322,5 +514,9 @@ func ParseLocalConfig(fileName string, conf interface{}) error {
 }
 
 func GetConfFilePath(fileName string) string {
-	return ConfEnvPath + "/" + fileName
+	return defaultApp.GetConfFilePath(fileName)
+}
+
+func (a *App) GetConfFilePath(fileName string) string {
+	return a.ConfEnvPath + "/" + fileName
 }
@@ -0,0 +1,299 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 配置源,Load返回 文件名(如 base.toml) -> 文件内容
+type ConfigProvider interface {
+	// 配置环境路径,如 ./conf/dev 或 nice_base/dev,用于 ConfEnvPath/ConfEnv
+	Path() string
+	Load(ctx context.Context) (map[string][]byte, error)
+	// 阻塞监听配置变化直到ctx结束,变化时回调完整快照
+	Watch(ctx context.Context, onChange func(map[string][]byte)) error
+}
+
+type FileProvider struct {
+	Dir      string
+	Interval time.Duration
+}
+
+func NewFileProvider(dir string) *FileProvider {
+	return &FileProvider{Dir: strings.TrimRight(dir, "/"), Interval: 5 * time.Second}
+}
+
+func (p *FileProvider) Path() string {
+	return p.Dir
+}
+
+// 和InitViperConf一致,读取目录下全部文件,不限于.toml
+func (p *FileProvider) Load(ctx context.Context) (map[string][]byte, error) {
+	entries, err := os.ReadDir(p.Dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string][]byte)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(p.Dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		snapshot[entry.Name()] = data
+	}
+	return snapshot, nil
+}
+
+func (p *FileProvider) Watch(ctx context.Context, onChange func(map[string][]byte)) error {
+	return pollConfProvider(ctx, p, p.Interval, onChange)
+}
+
+// 兼容Consul KV HTTP接口的配置源,key为 prefix/文件名
+type HTTPKVProvider struct {
+	Addr     string
+	Prefix   string
+	Token    string
+	Wait     time.Duration
+	Interval time.Duration
+	Client   *http.Client
+}
+
+type httpKVPair struct {
+	Key   string `json:"Key"`
+	Value []byte `json:"Value"`
+}
+
+func NewHTTPKVProvider(addr, prefix string) *HTTPKVProvider {
+	return &HTTPKVProvider{
+		Addr:     strings.TrimRight(addr, "/"),
+		Prefix:   strings.Trim(prefix, "/"),
+		Wait:     30 * time.Second,
+		Interval: 5 * time.Second,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *HTTPKVProvider) Path() string {
+	return p.Prefix
+}
+
+func (p *HTTPKVProvider) Load(ctx context.Context) (map[string][]byte, error) {
+	snapshot, _, err := p.fetch(ctx, 0)
+	return snapshot, err
+}
+
+func (p *HTTPKVProvider) Watch(ctx context.Context, onChange func(map[string][]byte)) error {
+	var index uint64
+	for {
+		snapshot, newIndex, err := p.fetch(ctx, index)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Printf("[WARN] watch config %s/%s fail:%v\n", p.Addr, p.Prefix, err)
+			if !sleepCtx(ctx, p.Interval) {
+				return ctx.Err()
+			}
+			continue
+		}
+		if newIndex == 0 {
+			// 后端不支持阻塞查询,退化为轮询
+			return pollConfProvider(ctx, p, p.Interval, onChange)
+		}
+		if index != 0 && newIndex != index {
+			onChange(snapshot)
+		}
+		index = newIndex
+	}
+}
+
+func (p *HTTPKVProvider) fetch(ctx context.Context, index uint64) (map[string][]byte, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	client := p.Client
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", p.Wait.String())
+		c := *client
+		c.Timeout = p.Wait + client.Timeout
+		client = &c
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", p.Addr+"/v1/kv/"+p.Prefix+"/?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if p.Token != "" {
+		req.Header.Set("X-Consul-Token", p.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("get config %s status %d", p.Prefix, resp.StatusCode)
+	}
+	pairs := []httpKVPair{}
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, 0, err
+	}
+	snapshot := make(map[string][]byte)
+	for _, pair := range pairs {
+		name := strings.TrimPrefix(strings.TrimPrefix(pair.Key, p.Prefix), "/")
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		snapshot[name] = pair.Value
+	}
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return snapshot, newIndex, nil
+}
+
+// 包装配置源,加载成功时落盘快照,后端不可用时使用最近一次成功的快照
+type SnapshotCacheProvider struct {
+	ConfigProvider
+	CacheFile string
+}
+
+func NewSnapshotCacheProvider(p ConfigProvider, cacheFile string) *SnapshotCacheProvider {
+	return &SnapshotCacheProvider{ConfigProvider: p, CacheFile: cacheFile}
+}
+
+func (p *SnapshotCacheProvider) Load(ctx context.Context) (map[string][]byte, error) {
+	snapshot, err := p.ConfigProvider.Load(ctx)
+	if err == nil {
+		if err := p.save(snapshot); err != nil {
+			log.Printf("[WARN] save config snapshot %s fail:%v\n", p.CacheFile, err)
+		}
+		return snapshot, nil
+	}
+	cached, cacheErr := p.load()
+	if cacheErr != nil {
+		return nil, fmt.Errorf("load config fail:%v, snapshot unavailable:%v", err, cacheErr)
+	}
+	log.Printf("[WARN] load config fail:%v, use snapshot %s\n", err, p.CacheFile)
+	return cached, nil
+}
+
+func (p *SnapshotCacheProvider) Watch(ctx context.Context, onChange func(map[string][]byte)) error {
+	return p.ConfigProvider.Watch(ctx, func(snapshot map[string][]byte) {
+		if err := p.save(snapshot); err != nil {
+			log.Printf("[WARN] save config snapshot %s fail:%v\n", p.CacheFile, err)
+		}
+		onChange(snapshot)
+	})
+}
+
+func (p *SnapshotCacheProvider) save(snapshot map[string][]byte) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.CacheFile), 0755); err != nil {
+		return err
+	}
+	tmp := p.CacheFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.CacheFile)
+}
+
+func (p *SnapshotCacheProvider) load() (map[string][]byte, error) {
+	data, err := os.ReadFile(p.CacheFile)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string][]byte)
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func pollConfProvider(ctx context.Context, p ConfigProvider, interval time.Duration, onChange func(map[string][]byte)) error {
+	last, _ := p.Load(ctx)
+	for sleepCtx(ctx, interval) {
+		snapshot, err := p.Load(ctx)
+		if err != nil {
+			log.Printf("[WARN] watch config %s fail:%v\n", p.Path(), err)
+			continue
+		}
+		if len(diffConfSnapshot(last, snapshot)) > 0 {
+			onChange(snapshot)
+		}
+		last = snapshot
+	}
+	return ctx.Err()
+}
+
+// 返回两个快照中内容不同的文件名
+func diffConfSnapshot(old, new map[string][]byte) []string {
+	var changed []string
+	for name, data := range new {
+		if oldData, ok := old[name]; !ok || !bytes.Equal(oldData, data) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (a *App) configProvider() ConfigProvider {
+	a.confLock.RLock()
+	defer a.confLock.RUnlock()
+	return a.confProvider
+}
+
+// 监听当前配置源,变化时刷新ViperConfMap并回调变化的文件名
+func WatchConf(ctx context.Context, onChange func(changed []string)) error {
+	return defaultApp.WatchConf(ctx, onChange)
+}
+
+func (a *App) WatchConf(ctx context.Context, onChange func(changed []string)) error {
+	provider := a.configProvider()
+	if provider == nil {
+		return errNoConfProvider
+	}
+	return provider.Watch(ctx, func(snapshot map[string][]byte) {
+		a.confLock.RLock()
+		changed := diffConfSnapshot(a.confSnapshot, snapshot)
+		a.confLock.RUnlock()
+		if err := a.setConfSnapshot(snapshot); err != nil {
+			log.Printf("[WARN] reload config %s fail:%v\n", provider.Path(), err)
+			return
+		}
+		if onChange != nil && len(changed) > 0 {
+			onChange(changed)
+		}
+	})
+}
@@ -0,0 +1,342 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/viper"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 配置结构体生成的JSON Schema(draft-07子集)
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 interface{}            `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Default              interface{}            `json:"default,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+}
+
+// 根据mapstructure/default/validate/description标签生成schema
+func GenerateJSONSchema(v interface{}) *JSONSchema {
+	schema := schemaForType(reflect.TypeOf(v))
+	schema.Schema = "http://json-schema.org/draft-07/schema#"
+	return schema
+}
+
+// 按登记的配置文件名生成schema,如 mysql_map
+func ConfJSONSchema(fileName string) (*JSONSchema, error) {
+	t, ok := ConfStructs()[strings.TrimSuffix(fileName, ".toml")]
+	if !ok {
+		return nil, fmt.Errorf("%w: no registered config struct for %v", ErrConfFileNotFound, fileName)
+	}
+	schema := schemaForType(t)
+	schema.Schema = "http://json-schema.org/draft-07/schema#"
+	schema.Title = strings.TrimSuffix(fileName, ".toml")
+	return schema, nil
+}
+
+func schemaForType(t reflect.Type) *JSONSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeOf(time.Duration(0)):
+		return &JSONSchema{Type: []string{"string", "integer"}, Description: "duration like 1m30s"}
+	case reflect.TypeOf(time.Time{}):
+		return &JSONSchema{Type: "string", Format: "date-time"}
+	case reflect.TypeOf(time.Location{}):
+		return &JSONSchema{Type: "string"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &JSONSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &JSONSchema{Type: "array", Items: schemaForType(t.Elem())}
+	case reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: schemaForType(t.Elem())}
+	case reflect.Struct:
+		schema := &JSONSchema{Type: "object", Properties: map[string]*JSONSchema{}, AdditionalProperties: false}
+		fields := confStructFields(t)
+		for name, field := range fields {
+			prop := schemaForType(field.Type)
+			if desc := field.Tag.Get("description"); desc != "" {
+				prop.Description = desc
+			}
+			if def, ok := field.Tag.Lookup("default"); ok {
+				prop.Default = parseSchemaDefault(def, field.Type)
+			}
+			if applySchemaValidate(prop, field.Tag.Get("validate"), field.Type) {
+				schema.Required = append(schema.Required, name)
+			}
+			schema.Properties[name] = prop
+		}
+		sort.Strings(schema.Required)
+		return schema
+	}
+	return &JSONSchema{}
+}
+
+func parseSchemaDefault(def string, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(def); err == nil {
+			return b
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if t == reflect.TypeOf(time.Duration(0)) {
+			return def
+		}
+		if n, err := strconv.ParseInt(def, 10, 64); err == nil {
+			return n
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, err := strconv.ParseFloat(def, 64); err == nil {
+			return f
+		}
+	case reflect.Slice:
+		return strings.Split(def, ",")
+	}
+	return def
+}
+
+// 解析validator风格标签(required,min=1,max=10,oneof=a b),返回是否必填
+func applySchemaValidate(schema *JSONSchema, tag string, t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	required := false
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch name {
+		case "required":
+			required = true
+		case "oneof":
+			for _, item := range strings.Fields(arg) {
+				schema.Enum = append(schema.Enum, parseSchemaDefault(item, t))
+			}
+		case "min", "max", "gte", "lte":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				continue
+			}
+			isMin := name == "min" || name == "gte"
+			switch t.Kind() {
+			case reflect.String:
+				size := int(n)
+				if isMin {
+					schema.MinLength = &size
+				} else {
+					schema.MaxLength = &size
+				}
+			case reflect.Slice, reflect.Array, reflect.Map:
+				size := int(n)
+				if isMin {
+					schema.MinItems = &size
+				} else {
+					schema.MaxItems = &size
+				}
+			default:
+				if isMin {
+					schema.Minimum = &n
+				} else {
+					schema.Maximum = &n
+				}
+			}
+		}
+	}
+	return required
+}
+
+// 校验配置值,返回形如 "list.default.max_open_conn: ..." 的错误
+func (s *JSONSchema) Validate(path string, value interface{}) []string {
+	var errs []string
+	s.validate(path, value, &errs)
+	sort.Strings(errs)
+	return errs
+}
+
+func (s *JSONSchema) validate(path string, value interface{}, errs *[]string) {
+	if !schemaTypeMatch(s.Type, value) {
+		*errs = append(*errs, fmt.Sprintf("%v: expect %v, got %T", path, s.Type, value))
+		return
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, item := range s.Enum {
+			if fmt.Sprint(item) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			*errs = append(*errs, fmt.Sprintf("%v: %v not in %v", path, value, s.Enum))
+		}
+	}
+	switch val := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := val[name]; !ok {
+				*errs = append(*errs, fmt.Sprintf("%v: missing required key", joinSchemaPath(path, name)))
+			}
+		}
+		for k, item := range val {
+			if prop, ok := s.Properties[k]; ok {
+				prop.validate(joinSchemaPath(path, k), item, errs)
+				continue
+			}
+			switch additional := s.AdditionalProperties.(type) {
+			case bool:
+				if !additional {
+					*errs = append(*errs, fmt.Sprintf("%v: unknown key", joinSchemaPath(path, k)))
+				}
+			case *JSONSchema:
+				additional.validate(joinSchemaPath(path, k), item, errs)
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(val) < *s.MinItems {
+			*errs = append(*errs, fmt.Sprintf("%v: need at least %d items", path, *s.MinItems))
+		}
+		if s.MaxItems != nil && len(val) > *s.MaxItems {
+			*errs = append(*errs, fmt.Sprintf("%v: need at most %d items", path, *s.MaxItems))
+		}
+		if s.Items != nil {
+			for i, item := range val {
+				s.Items.validate(fmt.Sprintf("%v[%d]", path, i), item, errs)
+			}
+		}
+	case string:
+		if s.MinLength != nil && len(val) < *s.MinLength {
+			*errs = append(*errs, fmt.Sprintf("%v: need at least %d chars", path, *s.MinLength))
+		}
+		if s.MaxLength != nil && len(val) > *s.MaxLength {
+			*errs = append(*errs, fmt.Sprintf("%v: need at most %d chars", path, *s.MaxLength))
+		}
+	default:
+		if n, ok := schemaNumber(value); ok {
+			if s.Minimum != nil && n < *s.Minimum {
+				*errs = append(*errs, fmt.Sprintf("%v: %v less than %v", path, value, *s.Minimum))
+			}
+			if s.Maximum != nil && n > *s.Maximum {
+				*errs = append(*errs, fmt.Sprintf("%v: %v greater than %v", path, value, *s.Maximum))
+			}
+		}
+	}
+}
+
+func joinSchemaPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func schemaTypeMatch(schemaType interface{}, value interface{}) bool {
+	switch t := schemaType.(type) {
+	case nil:
+		return true
+	case []string:
+		for _, item := range t {
+			if schemaTypeMatch(item, value) {
+				return true
+			}
+		}
+		return false
+	case string:
+		switch t {
+		case "string":
+			if _, ok := value.(time.Time); ok {
+				return true
+			}
+			_, ok := value.(string)
+			return ok
+		case "boolean":
+			_, ok := value.(bool)
+			return ok
+		case "integer":
+			switch value.(type) {
+			case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+				return true
+			}
+			return false
+		case "number":
+			_, ok := schemaNumber(value)
+			return ok
+		case "array":
+			_, ok := value.([]interface{})
+			return ok
+		case "object":
+			_, ok := value.(map[string]interface{})
+			return ok
+		}
+	}
+	return true
+}
+
+func schemaNumber(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// 用登记结构体的schema校验快照中的配置文件,未登记的文件跳过
+func ValidateConfSnapshot(snapshot map[string][]byte) ([]string, error) {
+	var errs []string
+	for name, data := range snapshot {
+		fileName := strings.TrimSuffix(name, ".toml")
+		schema, err := ConfJSONSchema(fileName)
+		if err != nil {
+			continue
+		}
+		v := viper.New()
+		v.SetConfigType("toml")
+		if err := v.ReadConfig(bytes.NewBuffer(data)); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+			continue
+		}
+		errs = append(errs, schema.Validate(fileName, v.AllSettings())...)
+	}
+	sort.Strings(errs)
+	return errs, nil
+}
+
+func (a *App) ValidateConf() ([]string, error) {
+	a.confLock.RLock()
+	snapshot := a.confSnapshot
+	a.confLock.RUnlock()
+	return ValidateConfSnapshot(snapshot)
+}
@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// 配置解密密钥(base64)
+	ConfKeyEnv = "NICE_CONF_KEY"
+	// 配置解密密钥文件路径
+	ConfKeyFileEnv = "NICE_CONF_KEY_FILE"
+	confSecretMask = "******"
+)
+
+var ErrConfKeyNotSet = errors.New("config key not set, export " + ConfKeyEnv + " or " + ConfKeyFileEnv)
+
+var encValueRegexp = regexp.MustCompile(`ENC\(([A-Za-z0-9+/=]+)\)`)
+
+// 从环境变量或密钥文件读取AES密钥
+func LoadConfKey() ([]byte, error) {
+	if s := os.Getenv(ConfKeyEnv); s != "" {
+		return parseConfKey([]byte(s))
+	}
+	if path := os.Getenv(ConfKeyFileEnv); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config key file %v error:%v", path, err)
+		}
+		return parseConfKey(data)
+	}
+	return nil, ErrConfKeyNotSet
+}
+
+func parseConfKey(data []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(data))
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && validConfKeyLen(len(key)) {
+		return key, nil
+	}
+	if validConfKeyLen(len(s)) {
+		return []byte(s), nil
+	}
+	return nil, errors.New("invalid config key, need base64 of 16/24/32 bytes")
+}
+
+func validConfKeyLen(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+func NewConfKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func IsEncryptedConfValue(s string) bool {
+	return encValueRegexp.MatchString(s)
+}
+
+// 加密为 ENC(base64(nonce+ciphertext)) 格式
+func EncryptConfValue(key []byte, plain string) (string, error) {
+	gcm, err := newConfGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return "ENC(" + base64.StdEncoding.EncodeToString(sealed) + ")", nil
+}
+
+// 解密字符串中所有 ENC(...) 片段,其余内容原样保留
+func DecryptConfValue(key []byte, value string) (string, error) {
+	plain, _, err := decryptConfValue(key, value)
+	return plain, err
+}
+
+func decryptConfValue(key []byte, value string) (string, []string, error) {
+	gcm, err := newConfGCM(key)
+	if err != nil {
+		return "", nil, err
+	}
+	var fragments []string
+	var decryptErr error
+	plain := encValueRegexp.ReplaceAllStringFunc(value, func(m string) string {
+		if decryptErr != nil {
+			return m
+		}
+		data, err := base64.StdEncoding.DecodeString(encValueRegexp.FindStringSubmatch(m)[1])
+		if err != nil || len(data) < gcm.NonceSize() {
+			decryptErr = errors.New("malformed encrypted value")
+			return m
+		}
+		out, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+		if err != nil {
+			decryptErr = errors.New("decrypt value fail, wrong key or corrupted data")
+			return m
+		}
+		fragments = append(fragments, string(out))
+		return string(out)
+	})
+	if decryptErr != nil {
+		return "", nil, decryptErr
+	}
+	return plain, fragments, nil
+}
+
+func newConfGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 解密viper中所有加密配置项,返回解密后的明文用于错误信息脱敏
+func decryptViperConf(v *viper.Viper) ([]string, error) {
+	var key []byte
+	var secrets []string
+	decrypt := func(confKey string, s string) (string, error) {
+		if !IsEncryptedConfValue(s) {
+			return s, nil
+		}
+		if key == nil {
+			k, err := LoadConfKey()
+			if err != nil {
+				return "", err
+			}
+			key = k
+		}
+		plain, fragments, err := decryptConfValue(key, s)
+		if err != nil {
+			return "", fmt.Errorf("decrypt config %v error:%v", confKey, err)
+		}
+		secrets = append(secrets, fragments...)
+		return plain, nil
+	}
+	for _, confKey := range v.AllKeys() {
+		switch val := v.Get(confKey).(type) {
+		case string:
+			plain, err := decrypt(confKey, val)
+			if err != nil {
+				return nil, err
+			}
+			if plain != val {
+				v.Set(confKey, plain)
+			}
+		case []interface{}:
+			changed := false
+			list := make([]interface{}, len(val))
+			for i, item := range val {
+				list[i] = item
+				if s, ok := item.(string); ok {
+					plain, err := decrypt(confKey, s)
+					if err != nil {
+						return nil, err
+					}
+					changed = changed || plain != s
+					list[i] = plain
+				}
+			}
+			if changed {
+				v.Set(confKey, list)
+			}
+		}
+	}
+	return secrets, nil
+}
+
+func maskConfSecrets(msg string, secrets []string) string {
+	for _, s := range secrets {
+		if s != "" {
+			msg = strings.ReplaceAll(msg, s, confSecretMask)
+		}
+	}
+	return msg
+}
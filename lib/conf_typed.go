@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	ErrConfFileNotFound = errors.New("config file not found")
+	ErrConfKeyNotFound  = errors.New("config key not found")
+	ErrConfTypeMismatch = errors.New("config type mismatch")
+)
+
+// 按 "文件名.key" 读取配置并转换为T,只传文件名时解析整个文件
+func Conf[T any](key string) (T, error) {
+	return AppConf[T](defaultApp, key)
+}
+
+// 同Conf,出错时panic,用于启动阶段读取必需配置
+func MustConf[T any](key string) T {
+	out, err := Conf[T](key)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// 从指定App读取配置,Go不支持泛型方法故以函数形式提供
+func AppConf[T any](a *App, key string) (T, error) {
+	var out T
+	fileName, subKey, _ := strings.Cut(key, ".")
+	a.confLock.RLock()
+	v, ok := a.ViperConfMap[fileName]
+	secrets := a.viperConfSecrets[fileName]
+	a.confLock.RUnlock()
+	if !ok || v == nil {
+		return out, fmt.Errorf("%w: %v", ErrConfFileNotFound, fileName)
+	}
+	var raw interface{}
+	if subKey == "" {
+		raw = v.AllSettings()
+	} else {
+		if !v.IsSet(subKey) {
+			return out, fmt.Errorf("%w: %v", ErrConfKeyNotFound, key)
+		}
+		raw = v.Get(subKey)
+	}
+	if err := decodeConf(raw, &out); err != nil {
+		msg := maskConfSecrets(err.Error(), secrets)
+		return out, fmt.Errorf("%w: %v %v", ErrConfTypeMismatch, key, msg)
+	}
+	return out, nil
+}
+
+func decodeConf(raw interface{}, out interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			stringToLocationHookFunc(),
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToTimeHookFunc(time.RFC3339),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		Result: out,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(raw)
+}
+
+func stringToLocationHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String || t != reflect.TypeOf(time.Location{}) {
+			return data, nil
+		}
+		loc, err := time.LoadLocation(data.(string))
+		if err != nil {
+			return nil, err
+		}
+		return *loc, nil
+	}
+}
+
+// 拆分 "文件名.key",文件未加载时返回false
+func (a *App) lookupViperConf(key string) (*viper.Viper, string, bool) {
+	keys := strings.Split(key, ".")
+	if len(keys) < 2 {
+		return nil, "", false
+	}
+	a.confLock.RLock()
+	v, ok := a.ViperConfMap[keys[0]]
+	a.confLock.RUnlock()
+	if !ok || v == nil {
+		return nil, "", false
+	}
+	return v, strings.Join(keys[1:], "."), true
+}
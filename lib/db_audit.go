@@ -0,0 +1,492 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/m17621679833/nice_base/nlog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// 单条语句记录修改前后数据的最大行数
+	AuditImageMaxRows = 100
+	// output为table时待写入审计表的队列长度,队列满时丢弃并记录告警
+	AuditQueueSize = 1024
+
+	errAuditQueueFull = errors.New("audit queue full")
+	errAuditClosed    = errors.New("audit writer closed")
+)
+
+var auditSQLRegexp = regexp.MustCompile("(?is)^\\s*(insert(?:\\s+ignore)?\\s+into|replace\\s+into|update(?:\\s+ignore)?|delete\\s+from)\\s+[`\"]?([\\w.]+)")
+
+// 一条写操作的审计记录,写入审计表时的列名见gorm标签
+type AuditRecord struct {
+	Id           int64     `json:"-" gorm:"column:id;primary_key;autoIncrement"`
+	TraceId      string    `json:"trace_id" gorm:"column:trace_id"`
+	User         string    `json:"user" gorm:"column:user"`
+	Pool         string    `json:"pool" gorm:"column:pool"`
+	Table        string    `json:"table" gorm:"column:table_name"`
+	Action       string    `json:"action" gorm:"column:action"`
+	SQL          string    `json:"sql" gorm:"column:sql_text"`
+	RowsAffected int64     `json:"rows_affected" gorm:"column:rows_affected"`
+	Before       string    `json:"before,omitempty" gorm:"column:before_image"`
+	After        string    `json:"after,omitempty" gorm:"column:after_image"`
+	Err          string    `json:"err,omitempty" gorm:"column:err"`
+	CreatedAt    time.Time `json:"created_at" gorm:"column:created_at"`
+}
+
+type AuditWriter interface {
+	WriteAudit(ctx context.Context, record *AuditRecord) error
+}
+
+type auditUserCtxKey struct{}
+
+// 在ctx中记录操作人,审计记录的User取自该值
+func WithAuditUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, auditUserCtxKey{}, user)
+}
+
+func SetGinAuditUser(c *gin.Context, user string) {
+	c.Set("audit_user", user)
+}
+
+func GetAuditUser(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if ginCTX, ok := ctx.(*gin.Context); ok {
+		return ginCTX.GetString("audit_user")
+	}
+	user, _ := ctx.Value(auditUserCtxKey{}).(string)
+	return user
+}
+
+// 替换审计输出,未配置[audit]时设置writer也会开启审计
+func SetAuditWriter(w AuditWriter) {
+	defaultApp.SetAuditWriter(w)
+}
+
+// 可在请求处理中并发替换,传nil恢复[audit]配置的输出
+func (a *App) SetAuditWriter(w AuditWriter) {
+	if w == nil {
+		a.auditWriter.Store(nil)
+		return
+	}
+	a.auditWriter.Store(&w)
+}
+
+type auditLogWriter struct {
+	log *LoggerFaced
+}
+
+func (w *auditLogWriter) WriteAudit(ctx context.Context, r *AuditRecord) error {
+	msg := map[string]interface{}{
+		"user":          r.User,
+		"pool":          r.Pool,
+		"table":         r.Table,
+		"action":        r.Action,
+		"sql":           r.SQL,
+		"rows_affected": r.RowsAffected,
+	}
+	if r.Before != "" {
+		msg["before"] = r.Before
+	}
+	if r.After != "" {
+		msg["after"] = r.After
+	}
+	if r.Err != "" {
+		msg["err"] = r.Err
+	}
+	w.log.TagInfo(GetTraceContext(ctx), NLTagMySqlAudit, msg)
+	return nil
+}
+
+// 审计表由后台goroutine异步写入,不经过业务事务,业务回滚不影响已写入的审计记录;
+// 同步写入在事务内会和业务事务争抢连接,max_open_conn=1或sqlite时会死锁
+type auditTableWriter struct {
+	db     *gorm.DB
+	table  string
+	log    *LoggerFaced
+	lock   sync.RWMutex
+	closed bool
+	queue  chan auditTableEntry
+	wg     sync.WaitGroup
+}
+
+type auditTableEntry struct {
+	ctx    context.Context
+	record *AuditRecord
+}
+
+func newAuditTableWriter(db *gorm.DB, table string, log *LoggerFaced) *auditTableWriter {
+	w := &auditTableWriter{db: db, table: table, log: log, queue: make(chan auditTableEntry, AuditQueueSize)}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for e := range w.queue {
+			if err := w.db.WithContext(e.ctx).Table(w.table).Create(e.record).Error; err != nil {
+				w.log.TagWarn(GetTraceContext(e.ctx), NLTagMySqlAudit, map[string]interface{}{
+					"pool":   e.record.Pool,
+					"table":  e.record.Table,
+					"action": e.record.Action,
+					"err":    err.Error(),
+				})
+			}
+		}
+	}()
+	return w
+}
+
+func (w *auditTableWriter) WriteAudit(ctx context.Context, r *AuditRecord) error {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.closed {
+		return errAuditClosed
+	}
+	select {
+	case w.queue <- auditTableEntry{ctx: context.WithoutCancel(ctx), record: r}:
+		return nil
+	default:
+		return errAuditQueueFull
+	}
+}
+
+// 写完队列中剩余的记录
+func (w *auditTableWriter) close() {
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.lock.Unlock()
+	w.wg.Wait()
+}
+
+type dbAuditor struct {
+	conf   DBAuditConf
+	log    *LoggerFaced
+	logger *nlog.Logger
+	writer AuditWriter
+}
+
+func (a *App) newDBAuditor(conf *DBAuditConf) (*dbAuditor, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	d := &dbAuditor{conf: *conf, log: a.Log}
+	if d.conf.Table == "" {
+		d.conf.Table = "sql_audit_log"
+	}
+	if d.conf.Pool == "" {
+		d.conf.Pool = "default"
+	}
+	if d.conf.Output == "table" {
+		return d, nil
+	}
+	log := a.Log
+	if d.conf.LogPath != "" {
+		d.logger = nlog.New()
+		err := nlog.SetupLogInstanceWithConf(&nlog.LogConfig{
+			LogLevel: "info",
+			FileWriter: nlog.FileWriterConf{
+				On:            true,
+				LogPath:       d.conf.LogPath,
+				RotateLogPath: d.conf.RotateLogPath,
+			},
+		}, d.logger)
+		if err != nil {
+			return nil, fmt.Errorf("audit log:%w", err)
+		}
+		d.logger.SetLayout("2024-05-10T15:21:23.000")
+		log = NewLoggerFaced(d.logger)
+	}
+	d.writer = &auditLogWriter{log: log}
+	return d, nil
+}
+
+// output为table时在连接池全部打开后创建
+func (d *dbAuditor) openTable(pools map[string]*gorm.DB) error {
+	if d == nil || d.conf.Output != "table" {
+		return nil
+	}
+	db, ok := pools[d.conf.Pool]
+	if !ok {
+		return fmt.Errorf("audit: unknown pool %v", d.conf.Pool)
+	}
+	d.writer = newAuditTableWriter(db, d.conf.Table, d.log)
+	return nil
+}
+
+func (d *dbAuditor) close() {
+	if d == nil {
+		return
+	}
+	if w, ok := d.writer.(*auditTableWriter); ok {
+		w.close()
+	}
+	if d.logger != nil {
+		d.logger.Close()
+	}
+}
+
+func (a *App) auditor() (AuditWriter, *dbAuditor) {
+	d := a.dbAudit
+	if w := a.auditWriter.Load(); w != nil {
+		return *w, d
+	}
+	if d == nil || d.writer == nil {
+		return nil, nil
+	}
+	return d.writer, d
+}
+
+func (d *dbAuditor) excluded(pool, table string) bool {
+	if d == nil {
+		return false
+	}
+	if d.conf.Output == "table" && pool == d.conf.Pool && table == d.conf.Table {
+		return true
+	}
+	return matchTableName(table, d.conf.ExcludeTables, false)
+}
+
+func (d *dbAuditor) withImage(table string) bool {
+	return d != nil && matchTableName(table, d.conf.ImageTables, false)
+}
+
+func (a *App) writeAudit(ctx context.Context, w AuditWriter, r *AuditRecord) {
+	r.TraceId = GetTraceContext(ctx).TraceId
+	r.User = GetAuditUser(ctx)
+	r.CreatedAt = time.Now()
+	if err := w.WriteAudit(ctx, r); err != nil {
+		a.Log.TagWarn(GetTraceContext(ctx), NLTagMySqlAudit, map[string]interface{}{
+			"pool":   r.Pool,
+			"table":  r.Table,
+			"action": r.Action,
+			"err":    err.Error(),
+		})
+	}
+}
+
+// 原生sql的写语句审计,无法获取修改前后的数据
+func (a *App) auditRawSQL(ctx context.Context, pool, sqlStr string, rows int64, err error) {
+	w, d := a.auditor()
+	if w == nil {
+		return
+	}
+	match := auditSQLRegexp.FindStringSubmatch(sqlStr)
+	if match == nil {
+		return
+	}
+	table := match[2]
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		table = table[i+1:]
+	}
+	if d.excluded(pool, table) {
+		return
+	}
+	action := strings.ToLower(strings.Fields(match[1])[0])
+	if action == "replace" {
+		action = "insert"
+	}
+	r := &AuditRecord{Pool: pool, Table: table, Action: action, SQL: sqlStr, RowsAffected: rows}
+	if err != nil {
+		r.Err = err.Error()
+	}
+	a.writeAudit(ctx, w, r)
+}
+
+// 注册在每个连接池上的审计插件,记录insert/update/delete及Exec执行的写语句
+type dbAuditPlugin struct {
+	app  *App
+	pool string
+}
+
+func (p *dbAuditPlugin) Name() string {
+	return "nice:audit"
+}
+
+const auditBeforeKey = "nice:audit_before"
+
+func (p *dbAuditPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().After("gorm:create").Register("nice:audit_create", p.afterCreate),
+		cb.Update().Before("gorm:update").Register("nice:audit_before_update", p.before),
+		cb.Update().After("gorm:update").Register("nice:audit_update", p.afterUpdate),
+		cb.Delete().Before("gorm:delete").Register("nice:audit_before_delete", p.before),
+		cb.Delete().After("gorm:delete").Register("nice:audit_delete", p.afterDelete),
+		cb.Raw().After("gorm:raw").Register("nice:audit_raw", p.afterRaw),
+	)
+}
+
+func (p *dbAuditPlugin) active(db *gorm.DB) (AuditWriter, *dbAuditor, bool) {
+	if db.DryRun || db.Statement.Table == "" {
+		return nil, nil, false
+	}
+	w, d := p.app.auditor()
+	if w == nil || d.excluded(p.pool, db.Statement.Table) {
+		return nil, nil, false
+	}
+	return w, d, true
+}
+
+func (p *dbAuditPlugin) before(db *gorm.DB) {
+	_, d, ok := p.active(db)
+	if !ok || db.Error != nil || !d.withImage(db.Statement.Table) {
+		return
+	}
+	if rows, err := p.selectRows(db, nil); err == nil {
+		db.InstanceSet(auditBeforeKey, rows)
+	}
+}
+
+func (p *dbAuditPlugin) afterCreate(db *gorm.DB) {
+	w, d, ok := p.active(db)
+	if !ok {
+		return
+	}
+	r := p.newRecord(db, "insert")
+	if db.Error == nil && d.withImage(db.Statement.Table) {
+		if _, ids := modelPrimaryKeys(db.Statement); len(ids) > 0 {
+			rows, _ := p.selectRows(db, ids)
+			r.After = auditImage(rows)
+		} else {
+			r.After = auditImage(db.Statement.Dest)
+		}
+	}
+	p.app.writeAudit(db.Statement.Context, w, r)
+}
+
+func (p *dbAuditPlugin) afterUpdate(db *gorm.DB) {
+	w, d, ok := p.active(db)
+	if !ok {
+		return
+	}
+	r := p.newRecord(db, "update")
+	if before, ok := db.InstanceGet(auditBeforeKey); ok {
+		rows := before.([]map[string]interface{})
+		r.Before = auditImage(rows)
+		if db.Error == nil && d.withImage(db.Statement.Table) {
+			// 条件可能引用被更新的列,有主键时按修改前数据的主键重新查询
+			if pk := primaryKeyColumn(db.Statement); pk == "" {
+				after, _ := p.selectRows(db, nil)
+				r.After = auditImage(after)
+			} else if len(rows) > 0 {
+				ids := make([]interface{}, 0, len(rows))
+				for _, row := range rows {
+					ids = append(ids, row[pk])
+				}
+				after, _ := p.selectRows(db, ids)
+				r.After = auditImage(after)
+			}
+		}
+	}
+	p.app.writeAudit(db.Statement.Context, w, r)
+}
+
+func (p *dbAuditPlugin) afterDelete(db *gorm.DB) {
+	w, _, ok := p.active(db)
+	if !ok {
+		return
+	}
+	r := p.newRecord(db, "delete")
+	if before, ok := db.InstanceGet(auditBeforeKey); ok {
+		r.Before = auditImage(before)
+	}
+	p.app.writeAudit(db.Statement.Context, w, r)
+}
+
+func (p *dbAuditPlugin) afterRaw(db *gorm.DB) {
+	if db.DryRun {
+		return
+	}
+	p.app.auditRawSQL(db.Statement.Context, p.pool, db.Dialector.Explain(db.Statement.SQL.String(), db.Statement.Vars...), db.RowsAffected, db.Error)
+}
+
+func (p *dbAuditPlugin) newRecord(db *gorm.DB, action string) *AuditRecord {
+	r := &AuditRecord{
+		Pool:         p.pool,
+		Table:        db.Statement.Table,
+		Action:       action,
+		SQL:          db.Dialector.Explain(db.Statement.SQL.String(), db.Statement.Vars...),
+		RowsAffected: db.RowsAffected,
+	}
+	if db.Error != nil {
+		r.Err = db.Error.Error()
+	}
+	return r
+}
+
+// 查询语句影响的行: ids非空时按主键查询,否则使用语句的where条件和模型值的主键
+func (p *dbAuditPlugin) selectRows(db *gorm.DB, ids []interface{}) ([]map[string]interface{}, error) {
+	stmt := db.Statement
+	query := db.Session(&gorm.Session{NewDB: true}).Table(stmt.Table).Limit(AuditImageMaxRows)
+	if len(ids) > 0 {
+		query = query.Where(clause.IN{Column: clause.Column{Name: primaryKeyColumn(stmt)}, Values: ids})
+	} else {
+		if where, ok := stmt.Clauses["WHERE"]; ok && where.Expression != nil {
+			query = query.Clauses(where.Expression)
+		}
+		if pk, modelIds := modelPrimaryKeys(stmt); len(modelIds) > 0 {
+			query = query.Where(clause.IN{Column: clause.Column{Name: pk}, Values: modelIds})
+		}
+	}
+	var rows []map[string]interface{}
+	err := query.Find(&rows).Error
+	return rows, err
+}
+
+func primaryKeyColumn(stmt *gorm.Statement) string {
+	if stmt.Schema == nil || stmt.Schema.PrioritizedPrimaryField == nil {
+		return ""
+	}
+	return stmt.Schema.PrioritizedPrimaryField.DBName
+}
+
+// 模型值(结构体或切片)中非零的主键值
+func modelPrimaryKeys(stmt *gorm.Statement) (string, []interface{}) {
+	pk := primaryKeyColumn(stmt)
+	if pk == "" || !stmt.ReflectValue.IsValid() {
+		return "", nil
+	}
+	field := stmt.Schema.PrioritizedPrimaryField
+	var ids []interface{}
+	add := func(v reflect.Value) {
+		v = reflect.Indirect(v)
+		if v.Kind() == reflect.Struct && v.Type() == stmt.Schema.ModelType {
+			if id, zero := field.ValueOf(stmt.Context, v); !zero {
+				ids = append(ids, id)
+			}
+		}
+	}
+	switch stmt.ReflectValue.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < stmt.ReflectValue.Len(); i++ {
+			add(stmt.ReflectValue.Index(i))
+		}
+	default:
+		add(stmt.ReflectValue)
+	}
+	return pk, ids
+}
+
+func auditImage(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,371 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDBBreakerOpen     = errors.New("db circuit breaker open")
+	ErrDBConnWaitTimeout = errors.New("db connection wait timeout")
+
+	// 计入熔断失败的mysql错误码: 连接数超限、服务关闭、锁等待超时、查询中断、执行超时
+	dbBreakerErrnos = map[uint16]bool{1040: true, 1053: true, 1203: true, 1205: true, 1226: true, 1317: true, 3024: true}
+
+	dbBreakerBuckets = 10
+)
+
+const (
+	DBBreakerClosed   = "closed"
+	DBBreakerOpen     = "open"
+	DBBreakerHalfOpen = "half_open"
+)
+
+// 熔断打开或等待连接超时时直接返回的错误,Err为ErrDBBreakerOpen或ErrDBConnWaitTimeout
+type DBRejectedError struct {
+	Pool       string
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *DBRejectedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("mysql %v:%v, retry after %v", e.Pool, e.Err, e.RetryAfter)
+	}
+	return fmt.Sprintf("mysql %v:%v", e.Pool, e.Err)
+}
+
+func (e *DBRejectedError) Unwrap() error {
+	return e.Err
+}
+
+type breakerBucket struct {
+	start    int64
+	requests int64
+	failures int64
+	slow     int64
+}
+
+type dbBreaker struct {
+	conf     DBBreakerConf
+	slow     time.Duration
+	window   time.Duration
+	open     time.Duration
+	lock     sync.Mutex
+	state    string
+	openedAt time.Time
+	probes   int
+	probesOK int
+	buckets  []breakerBucket
+}
+
+func newDBBreaker(conf DBBreakerConf, slow time.Duration) *dbBreaker {
+	if conf.ErrorRate <= 0 {
+		conf.ErrorRate = 0.5
+	}
+	if conf.MinRequests <= 0 {
+		conf.MinRequests = 20
+	}
+	if conf.WindowMs <= 0 {
+		conf.WindowMs = 10000
+	}
+	if conf.OpenMs <= 0 {
+		conf.OpenMs = 5000
+	}
+	if conf.HalfOpenRequests <= 0 {
+		conf.HalfOpenRequests = 1
+	}
+	if conf.SlowMs > 0 {
+		slow = time.Duration(conf.SlowMs) * time.Millisecond
+	}
+	return &dbBreaker{
+		conf:    conf,
+		slow:    slow,
+		window:  time.Duration(conf.WindowMs) * time.Millisecond,
+		open:    time.Duration(conf.OpenMs) * time.Millisecond,
+		state:   DBBreakerClosed,
+		buckets: make([]breakerBucket, dbBreakerBuckets),
+	}
+}
+
+// 返回放行与否、切换后的状态(未切换为空)和剩余打开时间
+func (b *dbBreaker) allow(now time.Time) (bool, string, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	changed := ""
+	if b.state == DBBreakerOpen {
+		if wait := b.open - now.Sub(b.openedAt); wait > 0 {
+			return false, "", wait
+		}
+		b.setState(DBBreakerHalfOpen)
+		changed = DBBreakerHalfOpen
+	}
+	if b.state == DBBreakerHalfOpen {
+		if b.probes >= b.conf.HalfOpenRequests {
+			return false, changed, 0
+		}
+		b.probes++
+	}
+	return true, changed, 0
+}
+
+// 上报一次请求结果,返回切换后的状态(未切换为空)
+func (b *dbBreaker) record(now time.Time, failure, slow bool) string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case DBBreakerHalfOpen:
+		// 打开前放行的请求不算探测
+		if b.probes == 0 {
+			return ""
+		}
+		b.probes--
+		if failure || slow {
+			b.trip(now)
+			return DBBreakerOpen
+		}
+		if b.probesOK++; b.probesOK >= b.conf.HalfOpenRequests {
+			b.setState(DBBreakerClosed)
+			return DBBreakerClosed
+		}
+	case DBBreakerClosed:
+		size := int64(b.window) / int64(len(b.buckets))
+		start := now.UnixNano() / size
+		bucket := &b.buckets[start%int64(len(b.buckets))]
+		if bucket.start != start {
+			*bucket = breakerBucket{start: start}
+		}
+		bucket.requests++
+		if failure {
+			bucket.failures++
+		}
+		if slow {
+			bucket.slow++
+		}
+		var requests, failures, slows int64
+		for _, bucket := range b.buckets {
+			if start-bucket.start < int64(len(b.buckets)) {
+				requests += bucket.requests
+				failures += bucket.failures
+				slows += bucket.slow
+			}
+		}
+		if requests < int64(b.conf.MinRequests) {
+			return ""
+		}
+		if (b.conf.ErrorRate > 0 && float64(failures)/float64(requests) >= b.conf.ErrorRate) ||
+			(b.conf.SlowRate > 0 && float64(slows)/float64(requests) >= b.conf.SlowRate) {
+			b.trip(now)
+			return DBBreakerOpen
+		}
+	}
+	return ""
+}
+
+func (b *dbBreaker) trip(now time.Time) {
+	b.setState(DBBreakerOpen)
+	b.openedAt = now
+}
+
+func (b *dbBreaker) setState(state string) {
+	b.state = state
+	b.probes = 0
+	b.probesOK = 0
+	if state == DBBreakerClosed {
+		b.buckets = make([]breakerBucket, len(b.buckets))
+	}
+}
+
+func (b *dbBreaker) current() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// 连接池的熔断和连接等待限制,两者均未配置时为nil
+type dbGuard struct {
+	pool    string
+	log     *LoggerFaced
+	breaker *dbBreaker
+	maxWait time.Duration
+}
+
+func newDBGuard(pool string, conf *MysqlConf, slow time.Duration, log *LoggerFaced) *dbGuard {
+	g := &dbGuard{pool: pool, log: log}
+	if conf.Breaker != nil {
+		g.breaker = newDBBreaker(*conf.Breaker, slow)
+	}
+	if conf.MaxConnWaitMs > 0 && conf.MaxOpenConn > 0 {
+		g.maxWait = time.Duration(conf.MaxConnWaitMs) * time.Millisecond
+	}
+	if g.breaker == nil && g.maxWait == 0 {
+		return nil
+	}
+	return g
+}
+
+// 执行结束上报结果并归还连接,重复调用只生效一次;cursor表示语句返回了未关闭的游标,连接在游标关闭后归还
+type dbGuardDone func(err error, elapsed time.Duration, cursor bool)
+
+// 通过熔断检查后返回本次语句使用的连接和done;配置了连接等待时从连接池(*sql.DB)独占取出一个连接,
+// 事务等已持有连接的不再等待
+func (g *dbGuard) enter(ctx context.Context, pool gorm.ConnPool) (gorm.ConnPool, dbGuardDone, error) {
+	if g == nil {
+		return pool, func(error, time.Duration, bool) {}, nil
+	}
+	if g.breaker != nil {
+		ok, changed, wait := g.breaker.allow(time.Now())
+		g.logState(changed)
+		if !ok {
+			return nil, nil, &DBRejectedError{Pool: g.pool, Err: ErrDBBreakerOpen, RetryAfter: wait}
+		}
+	}
+	var conn *sql.Conn
+	if db, ok := pool.(*sql.DB); ok && g.maxWait > 0 {
+		var err error
+		if conn, err = g.conn(ctx, db); err != nil {
+			g.report(err, 0)
+			return nil, nil, err
+		}
+		pool = conn
+	}
+	var once sync.Once
+	return pool, func(err error, elapsed time.Duration, cursor bool) {
+		once.Do(func() {
+			if conn != nil && cursor {
+				go conn.Close()
+			} else if conn != nil {
+				conn.Close()
+			}
+			g.report(err, elapsed)
+		})
+	}, nil
+}
+
+// 在max_conn_wait_ms内取得连接,连接被事务、未关闭的游标等占满时超时返回ErrDBConnWaitTimeout
+func (g *dbGuard) conn(ctx context.Context, db *sql.DB) (*sql.Conn, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, g.maxWait)
+	defer cancel()
+	conn, err := db.Conn(waitCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return nil, &DBRejectedError{Pool: g.pool, Err: ErrDBConnWaitTimeout}
+	}
+	return conn, err
+}
+
+func (g *dbGuard) report(err error, elapsed time.Duration) {
+	if g.breaker == nil {
+		return
+	}
+	slow := g.breaker.conf.SlowRate > 0 && g.breaker.slow > 0 && elapsed >= g.breaker.slow
+	g.logState(g.breaker.record(time.Now(), isDBBreakerFailure(err), slow))
+}
+
+func (g *dbGuard) logState(state string) {
+	if state == "" {
+		return
+	}
+	msg := map[string]interface{}{"pool": g.pool, "state": state}
+	if state == DBBreakerOpen {
+		g.log.TagWarn(NewTrace(), NLTagMySqlBreaker, msg)
+		return
+	}
+	g.log.TagInfo(NewTrace(), NLTagMySqlBreaker, msg)
+}
+
+// 业务类错误(无数据、主键冲突等)和调用方取消不计入熔断
+func isDBBreakerFailure(err error) bool {
+	if err == nil || errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, sql.ErrNoRows) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return dbBreakerErrnos[mysqlErr.Number]
+	}
+	return true
+}
+
+const (
+	dbGuardDoneKey  = "nice:db_guard_done"
+	dbGuardStartKey = "nice:db_guard_start"
+	dbGuardPoolKey  = "nice:db_guard_pool"
+)
+
+// 在gorm的增删改查回调前后接入熔断和连接等待,排在dbresolver选库之后;Row/Rows的连接在游标关闭后归还
+// 增删改在gorm开启默认事务前取得连接,默认事务在该连接上开启
+func (g *dbGuard) register(db *gorm.DB) error {
+	if g == nil {
+		return nil
+	}
+	var noop dbGuardDone = func(error, time.Duration, bool) {}
+	before := func(db *gorm.DB) {
+		// 同一语句复用时覆盖上一次的done,拒绝时存入空操作
+		db.InstanceSet(dbGuardDoneKey, noop)
+		db.InstanceSet(dbGuardPoolKey, db.Statement.ConnPool)
+		if db.Error != nil {
+			return
+		}
+		pool, done, err := g.enter(db.Statement.Context, db.Statement.ConnPool)
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		db.Statement.ConnPool = pool
+		db.InstanceSet(dbGuardDoneKey, done)
+		db.InstanceSet(dbGuardStartKey, time.Now())
+	}
+	after := func(db *gorm.DB) {
+		// 还原为取连接前的连接池,复用的语句不能继续使用已归还的连接
+		if pool, ok := db.InstanceGet(dbGuardPoolKey); ok {
+			db.Statement.ConnPool = pool.(gorm.ConnPool)
+		}
+		done, ok := db.InstanceGet(dbGuardDoneKey)
+		if !ok {
+			return
+		}
+		db.InstanceSet(dbGuardDoneKey, noop)
+		var elapsed time.Duration
+		if start, ok := db.InstanceGet(dbGuardStartKey); ok {
+			elapsed = time.Since(start.(time.Time))
+		}
+		cursor := false
+		switch db.Statement.Dest.(type) {
+		case *sql.Rows, *sql.Row:
+			cursor = true
+		}
+		done.(dbGuardDone)(db.Error, elapsed, cursor)
+	}
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:begin_transaction").Register("nice:guard_before_create", before),
+		cb.Create().After("gorm:commit_or_rollback_transaction").Register("nice:guard_after_create", after),
+		cb.Query().Before("gorm:query").Register("nice:guard_before_query", before),
+		cb.Query().After("gorm:query").Register("nice:guard_after_query", after),
+		cb.Update().Before("gorm:begin_transaction").Register("nice:guard_before_update", before),
+		cb.Update().After("gorm:commit_or_rollback_transaction").Register("nice:guard_after_update", after),
+		cb.Delete().Before("gorm:begin_transaction").Register("nice:guard_before_delete", before),
+		cb.Delete().After("gorm:commit_or_rollback_transaction").Register("nice:guard_after_delete", after),
+		cb.Row().Before("gorm:row").Register("nice:guard_before_row", before),
+		cb.Row().After("gorm:row").Register("nice:guard_after_row", after),
+		cb.Raw().Before("gorm:raw").Register("nice:guard_before_raw", before),
+		cb.Raw().After("gorm:raw").Register("nice:guard_after_raw", after),
+	)
+}
+
+// 熔断当前状态,未启用熔断返回空
+func (a *App) dbBreakerState(pool string) string {
+	if g := a.dbGuards[pool]; g != nil && g.breaker != nil {
+		return g.breaker.current()
+	}
+	return ""
+}
+
+func (a *App) enterDBGuard(ctx context.Context, poolName string, pool *sql.DB) (gorm.ConnPool, dbGuardDone, error) {
+	return a.dbGuards[poolName].enter(ctx, pool)
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"database/sql"
+	"fmt"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 数据库驱动: SQLDriver为sql.Open使用的驱动名,Dialector基于已打开的连接池创建gorm方言
+type DBDriver struct {
+	SQLDriver string
+	Dialector func(pool *sql.DB) gorm.Dialector
+	// 启动时数据库不可用使用,初始化不访问数据库;为空时使用Dialector
+	OfflineDialector func(pool *sql.DB) gorm.Dialector
+}
+
+var (
+	dbDriverLock sync.Mutex
+	dbDrivers    = map[string]DBDriver{}
+)
+
+func init() {
+	mysqlDriver := DBDriver{
+		SQLDriver: "mysql",
+		Dialector: func(pool *sql.DB) gorm.Dialector {
+			return mysql.New(mysql.Config{Conn: pool})
+		},
+		OfflineDialector: func(pool *sql.DB) gorm.Dialector {
+			return mysql.New(mysql.Config{Conn: pool, SkipInitializeWithVersion: true})
+		},
+	}
+	RegisterDBDriver("mysql", mysqlDriver)
+}
+
+// 注册driver_name对应的驱动,可覆盖内置的mysql;
+// postgres/sqlite需空白导入 lib/driver/postgres、lib/driver/sqlite 注册
+func RegisterDBDriver(name string, driver DBDriver) {
+	dbDriverLock.Lock()
+	defer dbDriverLock.Unlock()
+	dbDrivers[strings.ToLower(name)] = driver
+}
+
+// driver_name为空时默认mysql
+func GetDBDriver(name string) (DBDriver, error) {
+	if name == "" {
+		name = "mysql"
+	}
+	dbDriverLock.Lock()
+	defer dbDriverLock.Unlock()
+	driver, ok := dbDrivers[strings.ToLower(name)]
+	if !ok {
+		return DBDriver{}, fmt.Errorf("unknown driver_name %v", name)
+	}
+	return driver, nil
+}
+
+// 按配置打开连接池,从库沿用主库的驱动和连接池参数
+func openDBPool(driver DBDriver, conf *MysqlConf, dsn string) (*sql.DB, error) {
+	pool, err := sql.Open(driver.SQLDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	pool.SetMaxOpenConns(conf.MaxOpenConn)
+	pool.SetMaxIdleConns(conf.MaxIdleConn)
+	pool.SetConnMaxLifetime(time.Duration(conf.MaxConnLifeTime) * time.Second)
+	return pool, nil
+}
+
+// 数据库不可用时改用OfflineDialector,连接池在后台健康检查中自动恢复
+func (d DBDriver) dialector(pool *sql.DB, pingErr error) gorm.Dialector {
+	if pingErr != nil && d.OfflineDialector != nil {
+		return d.OfflineDialector(pool)
+	}
+	return d.Dialector(pool)
+}
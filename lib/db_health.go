@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+var (
+	DBHealthCheckInterval = 10 * time.Second
+	DBHealthCheckTimeout  = 3 * time.Second
+)
+
+// 连接池健康状态,从库名形如 default.replica0
+type DBHealthStatus struct {
+	Name      string        `json:"name"`
+	Up        bool          `json:"up"`
+	Latency   time.Duration `json:"latency"`
+	Err       string        `json:"err,omitempty"`
+	CheckedAt time.Time     `json:"checked_at"`
+	ChangedAt time.Time     `json:"changed_at"`
+	// 熔断状态 closed/open/half_open,未启用为空
+	Breaker string `json:"breaker,omitempty"`
+}
+
+type dbHealthChecker struct {
+	log    *LoggerFaced
+	pools  map[string]*sql.DB
+	lock   sync.RWMutex
+	status map[string]*DBHealthStatus
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newDBHealthChecker(log *LoggerFaced) *dbHealthChecker {
+	return &dbHealthChecker{
+		log:    log,
+		pools:  map[string]*sql.DB{},
+		status: map[string]*DBHealthStatus{},
+	}
+}
+
+// 加入检查列表并立即检查一次,start之前调用
+func (c *dbHealthChecker) add(name string, pool *sql.DB) error {
+	c.pools[name] = pool
+	return c.check(context.Background(), name, pool)
+}
+
+// 带超时ping并记录结果,返回ping错误
+func (c *dbHealthChecker) check(ctx context.Context, name string, pool *sql.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, DBHealthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := pool.PingContext(ctx)
+	c.record(name, time.Since(start), err)
+	return err
+}
+
+func (c *dbHealthChecker) record(name string, latency time.Duration, err error) {
+	now := time.Now()
+	c.lock.Lock()
+	status, ok := c.status[name]
+	if !ok {
+		status = &DBHealthStatus{Name: name}
+		c.status[name] = status
+	}
+	up := err == nil
+	changed := !ok || status.Up != up
+	status.Up = up
+	status.Latency = latency
+	status.Err = ""
+	if err != nil {
+		status.Err = err.Error()
+	}
+	status.CheckedAt = now
+	if changed {
+		status.ChangedAt = now
+	}
+	c.lock.Unlock()
+
+	if !changed || (!ok && up) {
+		return
+	}
+	msg := map[string]interface{}{
+		"pool":       name,
+		"latency_ms": float64(latency.Microseconds()) / 1000,
+	}
+	if up {
+		msg["state"] = "up"
+		c.log.TagInfo(NewTrace(), NLTagMySqlHealth, msg)
+	} else {
+		msg["state"] = "down"
+		msg["err"] = err.Error()
+		c.log.TagWarn(NewTrace(), NLTagMySqlHealth, msg)
+	}
+}
+
+// 周期性检查所有连接池,数据库恢复后database/sql会自动重建连接
+func (c *dbHealthChecker) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for sleepCtx(ctx, DBHealthCheckInterval) {
+			for name, pool := range c.pools {
+				c.check(ctx, name, pool)
+			}
+		}
+	}()
+}
+
+func (c *dbHealthChecker) stop() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.wg.Wait()
+}
+
+func (c *dbHealthChecker) snapshot() map[string]DBHealthStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	health := make(map[string]DBHealthStatus, len(c.status))
+	for name, status := range c.status {
+		health[name] = *status
+	}
+	return health
+}
+
+// 各连接池最近一次健康检查结果
+func DBHealth() map[string]DBHealthStatus {
+	return defaultApp.DBHealth()
+}
+
+func (a *App) DBHealth() map[string]DBHealthStatus {
+	if a.dbHealth == nil {
+		return map[string]DBHealthStatus{}
+	}
+	health := a.dbHealth.snapshot()
+	for name, status := range health {
+		status.Breaker = a.dbBreakerState(name)
+		health[name] = status
+	}
+	return health
+}
@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm/logger"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 指标注册表,HTTP服务通过MetricsHandler暴露
+var MetricsRegistry = prometheus.NewRegistry()
+
+// 查询耗时直方图最多记录的sql指纹数,超出后新指纹计入"other",避免标签基数无限增长
+var DBMetricsMaxFingerprints = 500
+
+var (
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nice",
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+		Help:      "Query latency by pool and SQL fingerprint.",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"pool", "fingerprint"})
+	dbQueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nice",
+		Subsystem: "db",
+		Name:      "query_errors_total",
+		Help:      "Query errors by pool and MySQL error number, other for non MySQL errors.",
+	}, []string{"pool", "errno"})
+	dbStats = &dbStatsCollector{pools: map[*App]map[string]*sql.DB{}, names: map[*App]string{}}
+
+	dbFingerprintLock sync.Mutex
+	dbFingerprints    = map[string]struct{}{}
+)
+
+func init() {
+	MetricsRegistry.MustRegister(dbQueryDuration, dbQueryErrors, dbStats)
+}
+
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{})
+}
+
+// 记录一次查询的耗时和错误,记录不存在不计为错误
+func ObserveDBQuery(pool, query string, elapsed time.Duration, err error) {
+	observeDBQuery(pool, SQLFingerprint(query), elapsed, err)
+}
+
+func observeDBQuery(pool, fingerprint string, elapsed time.Duration, err error) {
+	dbQueryDuration.WithLabelValues(pool, boundFingerprint(fingerprint)).Observe(elapsed.Seconds())
+	if err != nil && !errors.Is(err, logger.ErrRecordNotFound) && !errors.Is(err, sql.ErrNoRows) {
+		dbQueryErrors.WithLabelValues(pool, dbErrno(err)).Inc()
+	}
+}
+
+func boundFingerprint(fingerprint string) string {
+	dbFingerprintLock.Lock()
+	defer dbFingerprintLock.Unlock()
+	if _, ok := dbFingerprints[fingerprint]; ok {
+		return fingerprint
+	}
+	if len(dbFingerprints) >= DBMetricsMaxFingerprints {
+		return "other"
+	}
+	dbFingerprints[fingerprint] = struct{}{}
+	return fingerprint
+}
+
+func dbErrno(err error) string {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return strconv.Itoa(int(mysqlErr.Number))
+	}
+	return "other"
+}
+
+// 抓取时读取各连接池的sql.DBStats,app标签区分同一进程内的多个App
+type dbStatsCollector struct {
+	lock  sync.RWMutex
+	pools map[*App]map[string]*sql.DB
+	names map[*App]string
+	seq   int
+}
+
+var (
+	dbStatsLabels         = []string{"app", "env", "pool"}
+	dbStatsMaxOpen        = prometheus.NewDesc("nice_db_max_open_connections", "Maximum number of open connections.", dbStatsLabels, nil)
+	dbStatsOpen           = prometheus.NewDesc("nice_db_open_connections", "Number of established connections.", dbStatsLabels, nil)
+	dbStatsInUse          = prometheus.NewDesc("nice_db_in_use_connections", "Number of connections currently in use.", dbStatsLabels, nil)
+	dbStatsIdle           = prometheus.NewDesc("nice_db_idle_connections", "Number of idle connections.", dbStatsLabels, nil)
+	dbStatsWaitCount      = prometheus.NewDesc("nice_db_wait_count_total", "Total number of connections waited for.", dbStatsLabels, nil)
+	dbStatsWaitDuration   = prometheus.NewDesc("nice_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", dbStatsLabels, nil)
+	dbStatsMaxIdleClosed  = prometheus.NewDesc("nice_db_max_idle_closed_total", "Connections closed due to max_idle_conn.", dbStatsLabels, nil)
+	dbStatsMaxIdleTime    = prometheus.NewDesc("nice_db_max_idle_time_closed_total", "Connections closed due to max idle time.", dbStatsLabels, nil)
+	dbStatsLifetimeClosed = prometheus.NewDesc("nice_db_max_lifetime_closed_total", "Connections closed due to max_conn_life_time.", dbStatsLabels, nil)
+)
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{dbStatsMaxOpen, dbStatsOpen, dbStatsInUse, dbStatsIdle, dbStatsWaitCount,
+		dbStatsWaitDuration, dbStatsMaxIdleClosed, dbStatsMaxIdleTime, dbStatsLifetimeClosed} {
+		ch <- desc
+	}
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for a, pools := range c.pools {
+		for name, pool := range pools {
+			stats := pool.Stats()
+			labels := []string{c.names[a], a.ConfEnv, name}
+			ch <- prometheus.MustNewConstMetric(dbStatsMaxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections), labels...)
+			ch <- prometheus.MustNewConstMetric(dbStatsOpen, prometheus.GaugeValue, float64(stats.OpenConnections), labels...)
+			ch <- prometheus.MustNewConstMetric(dbStatsInUse, prometheus.GaugeValue, float64(stats.InUse), labels...)
+			ch <- prometheus.MustNewConstMetric(dbStatsIdle, prometheus.GaugeValue, float64(stats.Idle), labels...)
+			ch <- prometheus.MustNewConstMetric(dbStatsWaitCount, prometheus.CounterValue, float64(stats.WaitCount), labels...)
+			ch <- prometheus.MustNewConstMetric(dbStatsWaitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds(), labels...)
+			ch <- prometheus.MustNewConstMetric(dbStatsMaxIdleClosed, prometheus.CounterValue, float64(stats.MaxIdleClosed), labels...)
+			ch <- prometheus.MustNewConstMetric(dbStatsMaxIdleTime, prometheus.CounterValue, float64(stats.MaxIdleTimeClosed), labels...)
+			ch <- prometheus.MustNewConstMetric(dbStatsLifetimeClosed, prometheus.CounterValue, float64(stats.MaxLifetimeClosed), labels...)
+		}
+	}
+}
+
+// 登记App的连接池(含从库),pools为nil时移除
+func (c *dbStatsCollector) set(a *App, pools map[string]*sql.DB) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if pools == nil {
+		delete(c.pools, a)
+		delete(c.names, a)
+		return
+	}
+	c.pools[a] = pools
+	if _, ok := c.names[a]; ok {
+		return
+	}
+	if a.isDefault {
+		c.names[a] = "default"
+		return
+	}
+	c.seq++
+	c.names[a] = "app" + strconv.Itoa(c.seq)
+}
+
+// 根据*sql.DB反查连接池名,用于原生sql查询的指标
+func (c *dbStatsCollector) poolName(db *sql.DB) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, pools := range c.pools {
+		for name, pool := range pools {
+			if pool == db {
+				return name
+			}
+		}
+	}
+	return "unknown"
+}
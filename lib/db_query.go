@@ -0,0 +1,263 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gorm.io/gorm/logger"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// 连接池未配置query_timeout时的默认查询超时
+var DefaultDBQueryTimeout = 5 * time.Second
+
+type primaryCtxKey struct{}
+
+// 标记ctx内的原生sql查询走主库,用于写后立即读
+func PrimaryContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryCtxKey{}, true)
+}
+
+func (a *App) queryTimeout(poolName string) time.Duration {
+	if conf, ok := a.dbConfs[poolName]; ok && conf.QueryTimeout > 0 {
+		return time.Duration(conf.QueryTimeout) * time.Millisecond
+	}
+	return DefaultDBQueryTimeout
+}
+
+// 执行写语句,走主库
+func DBExec(ctx context.Context, poolName, query string, args ...interface{}) (sql.Result, error) {
+	return defaultApp.DBExec(ctx, poolName, query, args...)
+}
+
+func (a *App) DBExec(ctx context.Context, poolName, query string, args ...interface{}) (sql.Result, error) {
+	pool, err := a.GetDBPool(poolName)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.queryTimeout(poolName))
+	defer cancel()
+	conn, done, err := a.enterDBGuard(ctx, poolName, pool)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	result, err := conn.ExecContext(ctx, query, args...)
+	done(err, time.Since(start), false)
+	msg := map[string]interface{}{}
+	var affected int64
+	if err == nil {
+		if n, err := result.RowsAffected(); err == nil {
+			affected = n
+			msg["affected_rows"] = n
+		}
+	}
+	a.logDBQuery(ctx, poolName, query, args, start, msg, err)
+	if db, ok := a.GORMMapPool[poolName]; ok {
+		a.auditRawSQL(ctx, poolName, db.Dialector.Explain(query, args...), affected, err)
+	}
+	return result, err
+}
+
+// 查询单行,dest为结构体指针时按标签映射列,否则扫描单列到dest;无数据返回sql.ErrNoRows
+func DBQueryRow(ctx context.Context, poolName string, dest interface{}, query string, args ...interface{}) error {
+	return defaultApp.DBQueryRow(ctx, poolName, dest, query, args...)
+}
+
+func (a *App) DBQueryRow(ctx context.Context, poolName string, dest interface{}, query string, args ...interface{}) error {
+	return a.dbQuery(ctx, poolName, query, args, func(rows *sql.Rows) (int, error) {
+		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				return 0, err
+			}
+			return 0, sql.ErrNoRows
+		}
+		return 1, scanDBRow(rows, dest)
+	})
+}
+
+// 查询多行并扫描到结构体,列名匹配顺序: db标签 > gorm的column > json标签 > 字段名转下划线
+func DBQueryStructs[T any](ctx context.Context, poolName, query string, args ...interface{}) ([]T, error) {
+	return AppDBQueryStructs[T](defaultApp, ctx, poolName, query, args...)
+}
+
+func AppDBQueryStructs[T any](a *App, ctx context.Context, poolName, query string, args ...interface{}) ([]T, error) {
+	var out []T
+	err := a.dbQuery(ctx, poolName, query, args, func(rows *sql.Rows) (int, error) {
+		for rows.Next() {
+			var item T
+			if err := scanDBRow(rows, &item); err != nil {
+				return len(out), err
+			}
+			out = append(out, item)
+		}
+		return len(out), rows.Err()
+	})
+	return out, err
+}
+
+// 查询默认走从库,PrimaryContext标记时走主库
+func (a *App) dbQuery(ctx context.Context, poolName, query string, args []interface{}, scan func(rows *sql.Rows) (int, error)) error {
+	var pool *sql.DB
+	var err error
+	if primary, _ := ctx.Value(primaryCtxKey{}).(bool); primary {
+		pool, err = a.GetDBPool(poolName)
+	} else {
+		pool, err = a.GetDBReadPool(poolName)
+	}
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.queryTimeout(poolName))
+	defer cancel()
+	conn, done, err := a.enterDBGuard(ctx, poolName, pool)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		done(err, time.Since(start), false)
+		a.logDBQuery(ctx, poolName, query, args, start, map[string]interface{}{}, err)
+		return err
+	}
+	n, err := scan(rows)
+	rows.Close()
+	done(err, time.Since(start), false)
+	logErr := err
+	if errors.Is(err, sql.ErrNoRows) {
+		logErr = nil
+	}
+	a.logDBQuery(ctx, poolName, query, args, start, map[string]interface{}{"rows": n}, logErr)
+	return err
+}
+
+// 与gorm日志一致: 失败ERROR、慢查询WARN、其余Info级别输出,级别和参数输出按连接池配置
+func (a *App) logDBQuery(ctx context.Context, poolName, query string, args []interface{}, start time.Time, msg map[string]interface{}, err error) {
+	elapsed := time.Since(start)
+	fingerprint := SQLFingerprint(query)
+	observeDBQuery(poolName, fingerprint, elapsed, err)
+	threshold := a.slowThreshold(poolName)
+	slow := threshold > 0 && elapsed >= threshold
+	if a.slowQueries != nil && slow {
+		a.slowQueries.add(poolName, fingerprint, elapsed)
+	}
+	l, _ := a.poolLogger(poolName)
+	msg["pool"] = poolName
+	msg["sql"] = query
+	if !l.ParameterizedQueries {
+		msg["bind"] = args
+	}
+	msg["proc_time"] = fmt.Sprintf("%f", elapsed.Seconds())
+	trace := GetTraceContext(ctx)
+	switch {
+	case err != nil:
+		if l.LogLevel >= logger.Error {
+			msg["err"] = err.Error()
+			a.Log.TagError(trace, NLTagMySqlFailed, msg)
+		}
+	case slow:
+		if l.LogLevel >= logger.Warn {
+			msg["slowLog"] = fmt.Sprintf("SLOW SQL>=%v", threshold)
+			msg["fingerprint"] = fingerprint
+			a.Log.TagWarn(trace, NLTagMySqlSlow, msg)
+		}
+	case l.LogLevel >= logger.Info:
+		a.Log.TagInfo(trace, NLTagMySqlSuccess, msg)
+	}
+}
+
+func scanDBRow(rows *sql.Rows, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("scan dest must be a non-nil pointer, got %T", dest)
+	}
+	elem := v.Elem()
+	if elem.Kind() != reflect.Struct || elem.Type().ConvertibleTo(reflect.TypeOf(time.Time{})) ||
+		v.Type().Implements(reflect.TypeOf((*sql.Scanner)(nil)).Elem()) {
+		return rows.Scan(dest)
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	fields := dbStructFields(elem.Type())
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		index, ok := fields[strings.ToLower(column)]
+		if !ok {
+			targets[i] = new(sql.RawBytes)
+			continue
+		}
+		targets[i] = elem.FieldByIndex(index).Addr().Interface()
+	}
+	return rows.Scan(targets...)
+}
+
+var dbStructFieldCache sync.Map
+
+// 列名 -> 字段索引,匿名结构体字段展开
+func dbStructFields(t reflect.Type) map[string][]int {
+	if cached, ok := dbStructFieldCache.Load(t); ok {
+		return cached.(map[string][]int)
+	}
+	fields := map[string][]int{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			for name, index := range dbStructFields(field.Type) {
+				if _, ok := fields[name]; !ok {
+					fields[name] = append([]int{i}, index...)
+				}
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		name := dbColumnName(field)
+		if name == "-" {
+			continue
+		}
+		fields[strings.ToLower(name)] = []int{i}
+	}
+	dbStructFieldCache.Store(t, fields)
+	return fields
+}
+
+func dbColumnName(field reflect.StructField) string {
+	if tag, _, _ := strings.Cut(field.Tag.Get("db"), ","); tag != "" {
+		return tag
+	}
+	for _, opt := range strings.Split(field.Tag.Get("gorm"), ";") {
+		if key, value, ok := strings.Cut(opt, ":"); ok && strings.EqualFold(strings.TrimSpace(key), "column") {
+			return strings.TrimSpace(value)
+		}
+	}
+	if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); tag != "" {
+		return tag
+	}
+	return toSnakeCase(field.Name)
+}
+
+// CreatedAt -> created_at, UserID -> user_id
+func toSnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
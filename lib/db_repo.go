@@ -0,0 +1,370 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	// 分页默认/最大每页条数,批量插入每批条数
+	RepoDefaultPageSize = 20
+	RepoMaxPageSize     = 1000
+	RepoBatchSize       = 500
+
+	ErrRepoVersionConflict = errors.New("repo version conflict")
+)
+
+type RepoOption func(*repoOptions)
+
+type repoOptions struct {
+	softDelete string
+	version    string
+}
+
+// 软删除列: 时间列删除时写入当前时间、未删除为NULL;整数/布尔列删除时写1、未删除为0
+// 模型自带gorm.DeletedAt字段时无需配置,由gorm处理
+func WithRepoSoftDelete(column string) RepoOption {
+	return func(o *repoOptions) {
+		o.softDelete = column
+	}
+}
+
+// 乐观锁版本列,需为整数列
+func WithRepoVersion(column string) RepoOption {
+	return func(o *repoOptions) {
+		o.version = column
+	}
+}
+
+// 分页参数,Keyset为true时按Order列做游标分页,After为上一页返回的Next
+type PageQuery struct {
+	Page   int
+	Size   int
+	Order  string // 排序列,默认主键;游标分页时需唯一
+	Desc   bool
+	Keyset bool
+	After  interface{}
+}
+
+type PageResult[T any] struct {
+	Items []T         `json:"items"`
+	Total int64       `json:"total"`
+	Page  int         `json:"page,omitempty"`
+	Size  int         `json:"size"`
+	Next  interface{} `json:"next,omitempty"` // 游标分页的下一页游标,没有更多时为nil
+}
+
+// 绑定连接池的通用数据访问层,ctx中的trace随gorm日志输出,PrimaryContext标记时读主库
+type Repo[T any] struct {
+	app     *App
+	pool    string
+	opts    repoOptions
+	schemas sync.Map
+}
+
+func NewRepo[T any](pool string, opts ...RepoOption) *Repo[T] {
+	return AppNewRepo[T](defaultApp, pool, opts...)
+}
+
+func AppNewRepo[T any](a *App, pool string, opts ...RepoOption) *Repo[T] {
+	r := &Repo[T]{app: a, pool: pool}
+	for _, opt := range opts {
+		opt(&r.opts)
+	}
+	return r
+}
+
+// 查询条件,用于List的filters
+func RepoWhere(query interface{}, args ...interface{}) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(query, args...)
+	}
+}
+
+func (r *Repo[T]) open(ctx context.Context) (*gorm.DB, *schema.Schema, error) {
+	pool, err := r.app.GetGormPool(r.pool)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := schema.Parse(new(T), &r.schemas, pool.NamingStrategy)
+	if err != nil {
+		return nil, nil, err
+	}
+	db := pool.WithContext(ctx)
+	if primary, _ := ctx.Value(primaryCtxKey{}).(bool); primary {
+		db = UsePrimary(db)
+	}
+	return db.Session(&gorm.Session{}), s, nil
+}
+
+// 带模型和软删除条件的查询
+func (r *Repo[T]) scoped(ctx context.Context) (*gorm.DB, *schema.Schema, error) {
+	db, s, err := r.open(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	db = db.Model(new(T))
+	if r.opts.softDelete != "" {
+		field, err := repoField(s, r.opts.softDelete)
+		if err != nil {
+			return nil, nil, err
+		}
+		db = db.Where(clause.Eq{Column: repoColumn(field), Value: softDeleteValue(field, false)})
+	}
+	return db.Session(&gorm.Session{}), s, nil
+}
+
+func repoField(s *schema.Schema, column string) (*schema.Field, error) {
+	if field := s.LookUpField(column); field != nil && field.DBName != "" {
+		return field, nil
+	}
+	return nil, fmt.Errorf("%v has no column %v", s.Table, column)
+}
+
+func repoColumn(field *schema.Field) clause.Column {
+	return clause.Column{Table: clause.CurrentTable, Name: field.DBName}
+}
+
+func softDeleteValue(field *schema.Field, deleted bool) interface{} {
+	t := field.FieldType
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return deleted
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if deleted {
+			return 1
+		}
+		return 0
+	}
+	if deleted {
+		return time.Now()
+	}
+	return nil
+}
+
+func primaryField(s *schema.Schema) (*schema.Field, error) {
+	if s.PrioritizedPrimaryField == nil {
+		return nil, fmt.Errorf("%v has no primary key", s.Table)
+	}
+	return s.PrioritizedPrimaryField, nil
+}
+
+// 模型对应的*gorm.DB,已带软删除条件,用于Repo未覆盖的查询
+func (r *Repo[T]) DB(ctx context.Context) (*gorm.DB, error) {
+	db, _, err := r.scoped(ctx)
+	return db, err
+}
+
+// 按主键查询,无数据返回gorm.ErrRecordNotFound
+func (r *Repo[T]) Get(ctx context.Context, id interface{}) (*T, error) {
+	db, s, err := r.scoped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := primaryField(s)
+	if err != nil {
+		return nil, err
+	}
+	var out T
+	if err := db.Where(clause.Eq{Column: repoColumn(pk), Value: id}).Take(&out).Error; err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// 按filters分页查询,Total为满足filters的总数
+func (r *Repo[T]) List(ctx context.Context, page PageQuery, filters ...func(db *gorm.DB) *gorm.DB) (*PageResult[T], error) {
+	db, s, err := r.scoped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := primaryField(s)
+	if page.Order != "" {
+		order, err = repoField(s, page.Order)
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := page.Size
+	if size <= 0 {
+		size = RepoDefaultPageSize
+	}
+	if size > RepoMaxPageSize {
+		size = RepoMaxPageSize
+	}
+	result := &PageResult[T]{Items: []T{}, Size: size}
+	db = db.Scopes(filters...).Session(&gorm.Session{})
+	if err := db.Count(&result.Total).Error; err != nil {
+		return nil, err
+	}
+	column := repoColumn(order)
+	query := db.Order(clause.OrderByColumn{Column: column, Desc: page.Desc})
+	if !page.Keyset {
+		result.Page = max(page.Page, 1)
+		if err := query.Limit(size).Offset((result.Page - 1) * size).Find(&result.Items).Error; err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	if page.After != nil {
+		if page.Desc {
+			query = query.Where(clause.Lt{Column: column, Value: page.After})
+		} else {
+			query = query.Where(clause.Gt{Column: column, Value: page.After})
+		}
+	}
+	// 多取一条判断是否还有下一页
+	if err := query.Limit(size + 1).Find(&result.Items).Error; err != nil {
+		return nil, err
+	}
+	if len(result.Items) > size {
+		result.Items = result.Items[:size]
+		result.Next, _ = order.ValueOf(ctx, reflect.ValueOf(&result.Items[size-1]).Elem())
+	}
+	return result, nil
+}
+
+// 按RepoBatchSize分批插入,多于一批时在同一事务中执行,自增主键回填到items
+func (r *Repo[T]) BatchInsert(ctx context.Context, items []T) (int64, error) {
+	if len(items) == 0 {
+		return 0, nil
+	}
+	db, _, err := r.open(ctx)
+	if err != nil {
+		return 0, err
+	}
+	size := RepoBatchSize
+	if size <= 0 {
+		size = len(items)
+	}
+	result := db.CreateInBatches(&items, size)
+	return result.RowsAffected, result.Error
+}
+
+// 插入,主键或唯一键冲突时更新columns,columns为空时更新全部列
+func (r *Repo[T]) Upsert(ctx context.Context, value *T, columns ...string) error {
+	db, s, err := r.open(ctx)
+	if err != nil {
+		return err
+	}
+	onConflict := clause.OnConflict{UpdateAll: len(columns) == 0}
+	if len(columns) > 0 {
+		names := make([]string, 0, len(columns))
+		for _, column := range columns {
+			field, err := repoField(s, column)
+			if err != nil {
+				return err
+			}
+			names = append(names, field.DBName)
+		}
+		onConflict.DoUpdates = clause.AssignmentColumns(names)
+		for _, pk := range s.PrimaryFields {
+			onConflict.Columns = append(onConflict.Columns, clause.Column{Name: pk.DBName})
+		}
+	}
+	return db.Clauses(onConflict).Create(value).Error
+}
+
+// 按主键更新columns,columns为空时更新除主键外的全部列
+// 配置版本列时仅在版本号与value一致时更新,成功后value的版本号加1,否则返回ErrRepoVersionConflict
+func (r *Repo[T]) Update(ctx context.Context, value *T, columns ...string) error {
+	db, s, err := r.scoped(ctx)
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(value).Elem()
+	for _, pk := range s.PrimaryFields {
+		id, zero := pk.ValueOf(ctx, rv)
+		if zero {
+			return fmt.Errorf("%v update without primary key %v", s.Table, pk.DBName)
+		}
+		db = db.Where(clause.Eq{Column: repoColumn(pk), Value: id})
+	}
+	var version *schema.Field
+	if r.opts.version != "" {
+		if version, err = repoField(s, r.opts.version); err != nil {
+			return err
+		}
+	}
+	values := map[string]interface{}{}
+	if len(columns) == 0 {
+		for _, field := range s.Fields {
+			if field.DBName != "" && !field.PrimaryKey && field.Updatable && field != version {
+				values[field.DBName], _ = field.ValueOf(ctx, rv)
+			}
+		}
+	}
+	for _, column := range columns {
+		field, err := repoField(s, column)
+		if err != nil {
+			return err
+		}
+		values[field.DBName], _ = field.ValueOf(ctx, rv)
+	}
+	if version == nil {
+		return db.Updates(values).Error
+	}
+
+	current := version.ReflectValueOf(ctx, rv)
+	switch current.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return fmt.Errorf("%v version column %v is not an integer", s.Table, version.DBName)
+	}
+	values[version.DBName] = gorm.Expr("? + 1", clause.Column{Name: version.DBName})
+	result := db.Where(clause.Eq{Column: repoColumn(version), Value: current.Interface()}).Updates(values)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRepoVersionConflict
+	}
+	if current.CanInt() {
+		current.SetInt(current.Int() + 1)
+	} else {
+		current.SetUint(current.Uint() + 1)
+	}
+	return nil
+}
+
+// 按主键删除,配置软删除列或模型含gorm.DeletedAt时为软删除;记录不存在返回gorm.ErrRecordNotFound
+func (r *Repo[T]) Delete(ctx context.Context, id interface{}) error {
+	db, s, err := r.scoped(ctx)
+	if err != nil {
+		return err
+	}
+	pk, err := primaryField(s)
+	if err != nil {
+		return err
+	}
+	db = db.Where(clause.Eq{Column: repoColumn(pk), Value: id})
+	var result *gorm.DB
+	if r.opts.softDelete != "" {
+		field, err := repoField(s, r.opts.softDelete)
+		if err != nil {
+			return err
+		}
+		result = db.Update(field.DBName, softDeleteValue(field, true))
+	} else {
+		result = db.Delete(new(T))
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
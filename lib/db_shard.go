@@ -0,0 +1,281 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"hash/crc32"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 跨分片查询的最大并发
+var ShardScatterConcurrency = 8
+
+// 一个物理分片: 逻辑表名、分表编号、连接池和物理表名
+type Shard struct {
+	Name  string `json:"name"`
+	Index int    `json:"index"`
+	Pool  string `json:"pool"`
+	Table string `json:"table"`
+}
+
+type shardRouter struct {
+	conf   *ShardConf
+	shards []Shard
+	pools  map[string]*gorm.DB
+}
+
+func newShardRouter(name string, conf *ShardConf, pools map[string]*gorm.DB) (*shardRouter, error) {
+	count := conf.TableCount
+	if count <= 0 {
+		count = 1
+	}
+	switch conf.Algorithm {
+	case "", "mod", "hash_range":
+	default:
+		return nil, fmt.Errorf("shard %v: unknown algorithm %v", name, conf.Algorithm)
+	}
+	if conf.Algorithm == "hash_range" && conf.Slots > 0 && conf.Slots < count {
+		return nil, fmt.Errorf("shard %v: slots %d less than table_count %d", name, conf.Slots, count)
+	}
+	if conf.ShardKey == "" || conf.Table == "" {
+		return nil, fmt.Errorf("shard %v: shard_key and table are required", name)
+	}
+	suffix := conf.SuffixFormat
+	if suffix == "" {
+		suffix = fmt.Sprintf("_%%0%dd", max(2, len(strconv.Itoa(count-1))))
+	}
+	r := &shardRouter{conf: conf, shards: make([]Shard, count), pools: map[string]*gorm.DB{}}
+	assigned := make([]bool, count)
+	for _, node := range conf.Nodes {
+		pool, ok := pools[node.Pool]
+		if !ok {
+			return nil, fmt.Errorf("shard %v: unknown pool %v", name, node.Pool)
+		}
+		r.pools[node.Pool] = pool
+		lo, hi, err := parseShardRange(node.Tables)
+		if err != nil {
+			return nil, fmt.Errorf("shard %v:%w", name, err)
+		}
+		if hi >= count {
+			return nil, fmt.Errorf("shard %v: tables %v out of table_count %d", name, node.Tables, count)
+		}
+		for i := lo; i <= hi; i++ {
+			if assigned[i] {
+				return nil, fmt.Errorf("shard %v: table %d assigned to more than one node", name, i)
+			}
+			assigned[i] = true
+			table := conf.Table
+			if suffix != "none" {
+				table += fmt.Sprintf(suffix, i)
+			}
+			r.shards[i] = Shard{Name: name, Index: i, Pool: node.Pool, Table: table}
+		}
+	}
+	for i, ok := range assigned {
+		if !ok {
+			return nil, fmt.Errorf("shard %v: table %d not assigned to any node", name, i)
+		}
+	}
+	return r, nil
+}
+
+// "0-31" 或 "7"
+func parseShardRange(s string) (int, int, error) {
+	from, to, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	lo, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid tables %q", s)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.Atoi(strings.TrimSpace(to)); err != nil || hi < lo {
+			return 0, 0, fmt.Errorf("invalid tables %q", s)
+		}
+	}
+	if lo < 0 {
+		return 0, 0, fmt.Errorf("invalid tables %q", s)
+	}
+	return lo, hi, nil
+}
+
+// mod: 整数键取模,字符串键先crc32;hash_range: crc32落到槽位,每张表认领连续的槽位段
+func (r *shardRouter) route(key interface{}) (Shard, error) {
+	value, err := shardKeyValue(key, r.conf.ShardKey)
+	if err != nil {
+		return Shard{}, err
+	}
+	count := uint64(len(r.shards))
+	var index uint64
+	if r.conf.Algorithm == "hash_range" {
+		slots := uint64(r.conf.Slots)
+		if slots == 0 {
+			slots = max(count, 1024)
+		}
+		slot := uint64(crc32.ChecksumIEEE([]byte(fmt.Sprint(value)))) % slots
+		index = slot * count / slots
+	} else {
+		switch v := value.(type) {
+		case int64:
+			// 在uint64上取绝对值,MinInt64取反不会溢出
+			u := uint64(v)
+			if v < 0 {
+				u = -u
+			}
+			index = u % count
+		case uint64:
+			index = v % count
+		case string:
+			index = uint64(crc32.ChecksumIEEE([]byte(v))) % count
+		}
+	}
+	return r.shards[index], nil
+}
+
+// 分片键支持整数、字符串、[]byte,或含shard_key列对应字段的结构体
+func shardKeyValue(key interface{}, column string) (interface{}, error) {
+	v := reflect.ValueOf(key)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Struct {
+		index, ok := dbStructFields(v.Type())[strings.ToLower(column)]
+		if !ok {
+			return nil, fmt.Errorf("shard key %v not found in %v", column, v.Type())
+		}
+		v = v.FieldByIndex(index)
+		for v.Kind() == reflect.Ptr && !v.IsNil() {
+			v = v.Elem()
+		}
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes()), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported shard key type %T", key)
+}
+
+func (a *App) shardRouter(name string) (*shardRouter, error) {
+	if r, ok := a.dbShards[name]; ok {
+		return r, nil
+	}
+	return nil, fmt.Errorf("shard %v not configured", name)
+}
+
+// 按分片键定位物理分片
+func ShardOf(name string, key interface{}) (Shard, error) {
+	return defaultApp.ShardOf(name, key)
+}
+
+func (a *App) ShardOf(name string, key interface{}) (Shard, error) {
+	r, err := a.shardRouter(name)
+	if err != nil {
+		return Shard{}, err
+	}
+	return r.route(key)
+}
+
+// 逻辑表的全部分片,按编号排序
+func Shards(name string) ([]Shard, error) {
+	return defaultApp.Shards(name)
+}
+
+func (a *App) Shards(name string) ([]Shard, error) {
+	r, err := a.shardRouter(name)
+	if err != nil {
+		return nil, err
+	}
+	return append([]Shard(nil), r.shards...), nil
+}
+
+// 返回已切到分片连接池和物理表的*gorm.DB,可重复用于多次查询
+func ShardDB(ctx context.Context, name string, key interface{}) (*gorm.DB, error) {
+	return defaultApp.ShardDB(ctx, name, key)
+}
+
+func (a *App) ShardDB(ctx context.Context, name string, key interface{}) (*gorm.DB, error) {
+	r, err := a.shardRouter(name)
+	if err != nil {
+		return nil, err
+	}
+	shard, err := r.route(key)
+	if err != nil {
+		return nil, err
+	}
+	return r.db(ctx, shard), nil
+}
+
+func (r *shardRouter) db(ctx context.Context, shard Shard) *gorm.DB {
+	return r.pools[shard.Pool].WithContext(ctx).Table(shard.Table).Session(&gorm.Session{})
+}
+
+// 在全部分片上并发执行fn,返回所有分片的错误
+func ShardScatter(ctx context.Context, name string, fn func(ctx context.Context, db *gorm.DB, shard Shard) error) error {
+	return defaultApp.ShardScatter(ctx, name, fn)
+}
+
+func (a *App) ShardScatter(ctx context.Context, name string, fn func(ctx context.Context, db *gorm.DB, shard Shard) error) error {
+	r, err := a.shardRouter(name)
+	if err != nil {
+		return err
+	}
+	limit := ShardScatterConcurrency
+	if limit <= 0 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	errs := make([]error, len(r.shards))
+	var wg sync.WaitGroup
+	for i, shard := range r.shards {
+		// ctx取消后不再等待并发槽位,未执行的分片记为ctx的错误
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = fmt.Errorf("%v:%w", shard.Table, ctx.Err())
+			continue
+		}
+		wg.Add(1)
+		go func(i int, shard Shard) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(ctx, r.db(ctx, shard), shard); err != nil {
+				errs[i] = fmt.Errorf("%v:%w", shard.Table, err)
+			}
+		}(i, shard)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// 跨分片查询并合并结果,按分片编号顺序拼接;排序和分页需调用方在合并后处理
+func ShardFind[T any](ctx context.Context, name string, query func(db *gorm.DB) *gorm.DB) ([]T, error) {
+	return AppShardFind[T](defaultApp, ctx, name, query)
+}
+
+func AppShardFind[T any](a *App, ctx context.Context, name string, query func(db *gorm.DB) *gorm.DB) ([]T, error) {
+	r, err := a.shardRouter(name)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([][]T, len(r.shards))
+	err = a.ShardScatter(ctx, name, func(ctx context.Context, db *gorm.DB, shard Shard) error {
+		return query(db).Find(&parts[shard.Index]).Error
+	})
+	var out []T
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out, err
+}
@@ -0,0 +1,226 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// 慢查询汇总输出到日志的周期和条数
+	SlowQueryReportInterval = time.Minute
+	SlowQueryReportTopN     = 10
+
+	slowQuerySampleSize      = 512
+	slowQueryMaxFingerprints = 1000
+)
+
+// 单个sql模板在统计窗口内的慢查询汇总
+type SlowQueryStat struct {
+	Pool        string  `json:"pool"`
+	Fingerprint string  `json:"fingerprint"`
+	Count       int64   `json:"count"`
+	TotalMs     float64 `json:"total_ms"`
+	P95Ms       float64 `json:"p95_ms"`
+	MaxMs       float64 `json:"max_ms"`
+}
+
+type SlowQueryReport struct {
+	Start time.Time       `json:"start"`
+	End   time.Time       `json:"end"`
+	Top   []SlowQueryStat `json:"top"`
+}
+
+type slowQueryEntry struct {
+	count   int64
+	total   time.Duration
+	max     time.Duration
+	samples []time.Duration
+	next    int
+}
+
+func (e *slowQueryEntry) add(elapsed time.Duration) {
+	e.count++
+	e.total += elapsed
+	if elapsed > e.max {
+		e.max = elapsed
+	}
+	if len(e.samples) < slowQuerySampleSize {
+		e.samples = append(e.samples, elapsed)
+		return
+	}
+	e.samples[e.next] = elapsed
+	e.next = (e.next + 1) % slowQuerySampleSize
+}
+
+func (e *slowQueryEntry) p95() time.Duration {
+	sorted := append([]time.Duration(nil), e.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := int(math.Ceil(float64(len(sorted))*0.95)) - 1
+	if index < 0 {
+		return 0
+	}
+	return sorted[index]
+}
+
+type slowQueryKey struct {
+	pool        string
+	fingerprint string
+}
+
+// 按 连接池+sql模板 聚合慢查询,周期性输出top N后重置窗口
+type slowQueryAggregator struct {
+	log     *LoggerFaced
+	lock    sync.Mutex
+	start   time.Time
+	entries map[slowQueryKey]*slowQueryEntry
+	last    *SlowQueryReport
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func newSlowQueryAggregator(log *LoggerFaced) *slowQueryAggregator {
+	return &slowQueryAggregator{
+		log:     log,
+		start:   time.Now(),
+		entries: map[slowQueryKey]*slowQueryEntry{},
+	}
+}
+
+func (s *slowQueryAggregator) add(pool, fingerprint string, elapsed time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := slowQueryKey{pool: pool, fingerprint: fingerprint}
+	entry, ok := s.entries[key]
+	if !ok {
+		if len(s.entries) >= slowQueryMaxFingerprints {
+			return
+		}
+		entry = &slowQueryEntry{}
+		s.entries[key] = entry
+	}
+	entry.add(elapsed)
+}
+
+// 当前窗口按总耗时排序的前n条
+func (s *slowQueryAggregator) top(n int) []SlowQueryStat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.topLocked(n)
+}
+
+func (s *slowQueryAggregator) topLocked(n int) []SlowQueryStat {
+	stats := make([]SlowQueryStat, 0, len(s.entries))
+	for key, entry := range s.entries {
+		stats = append(stats, SlowQueryStat{
+			Pool:        key.pool,
+			Fingerprint: key.fingerprint,
+			Count:       entry.count,
+			TotalMs:     durationMs(entry.total),
+			P95Ms:       durationMs(entry.p95()),
+			MaxMs:       durationMs(entry.max),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].TotalMs != stats[j].TotalMs {
+			return stats[i].TotalMs > stats[j].TotalMs
+		}
+		return stats[i].Fingerprint < stats[j].Fingerprint
+	})
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// 结束当前窗口,返回窗口报告
+func (s *slowQueryAggregator) rotate() *SlowQueryReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	report := &SlowQueryReport{Start: s.start, End: now, Top: s.topLocked(SlowQueryReportTopN)}
+	s.start = now
+	s.entries = map[slowQueryKey]*slowQueryEntry{}
+	s.last = report
+	return report
+}
+
+func (s *slowQueryAggregator) lastReport() *SlowQueryReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.last
+}
+
+func (s *slowQueryAggregator) report() {
+	report := s.rotate()
+	if len(report.Top) == 0 {
+		return
+	}
+	s.log.TagWarn(NewTrace(), NLTagMySqlSlowReport, map[string]interface{}{
+		"start": report.Start.Format(time.RFC3339),
+		"end":   report.End.Format(time.RFC3339),
+		"top":   report.Top,
+	})
+}
+
+func (s *slowQueryAggregator) startReport() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for sleepCtx(ctx, SlowQueryReportInterval) {
+			s.report()
+		}
+	}()
+}
+
+// 停止周期输出,关闭前把未输出的窗口写入日志
+func (s *slowQueryAggregator) stop() {
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.wg.Wait()
+	s.report()
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// 慢查询阈值: 连接池配置slow_threshold_ms,未配置使用DefaultMysqlGormLogger.SlowThreshold
+func (a *App) slowThreshold(poolName string) time.Duration {
+	if conf, ok := a.dbConfs[poolName]; ok && conf.SlowThresholdMs > 0 {
+		return time.Duration(conf.SlowThresholdMs) * time.Millisecond
+	}
+	return DefaultMysqlGormLogger.SlowThreshold
+}
+
+// 慢查询汇总接口: GET ?n=10 返回当前窗口top N和上一个周期的报告
+func SlowQueryHandler() http.Handler {
+	return defaultApp.SlowQueryHandler()
+}
+
+func (a *App) SlowQueryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := SlowQueryReportTopN
+		if v, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && v > 0 {
+			n = v
+		}
+		result := map[string]interface{}{"current": []SlowQueryStat{}}
+		if s := a.slowQueries; s != nil {
+			result["current"] = s.top(n)
+			result["last"] = s.lastReport()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	})
+}
@@ -0,0 +1,327 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"golang.org/x/sync/singleflight"
+	"gorm.io/gorm"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// 检查懒加载租户连接池空闲的间隔
+	TenantEvictInterval = time.Minute
+
+	// 未配置idle_timeout时懒加载租户连接池的空闲关闭时间
+	DefaultTenantIdleTimeout = 600 * time.Second
+
+	ErrNoTenant = errors.New("no tenant in context")
+
+	tenantIdRegexp = regexp.MustCompile(`^[\w-]+$`)
+)
+
+// 从ctx中解析租户id,默认读取SetTenantContext/SetGinTenant写入的值
+type TenantResolver func(ctx context.Context) (string, error)
+
+func defaultTenantResolver(ctx context.Context) (string, error) {
+	if tenant := GetTenantId(ctx); tenant != "" {
+		return tenant, nil
+	}
+	return "", ErrNoTenant
+}
+
+func SetTenantResolver(resolver TenantResolver) {
+	defaultApp.SetTenantResolver(resolver)
+}
+
+// 可在请求处理中并发替换,传nil恢复默认解析
+func (a *App) SetTenantResolver(resolver TenantResolver) {
+	if resolver == nil {
+		a.tenantResolver.Store(nil)
+		return
+	}
+	a.tenantResolver.Store(&resolver)
+}
+
+// lastUsed/inflight由gorm回调在每条语句前后维护,执行中的连接池不会被回收;
+// 但持有*gorm.DB超过idle_timeout不使用时仍会被关闭,不要跨请求缓存TenantDB的返回值
+type tenantPool struct {
+	db       *gorm.DB
+	pool     *sql.DB
+	lastUsed atomic.Int64
+	inflight atomic.Int64
+}
+
+func (p *tenantPool) touch() {
+	p.lastUsed.Store(time.Now().UnixNano())
+}
+
+func (p *tenantPool) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, p.lastUsed.Load()))
+}
+
+func (p *tenantPool) register() error {
+	before := func(db *gorm.DB) {
+		p.inflight.Add(1)
+		p.touch()
+	}
+	after := func(db *gorm.DB) {
+		p.touch()
+		p.inflight.Add(-1)
+	}
+	cb := p.db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:begin_transaction").Register("nice:tenant_before_create", before),
+		cb.Create().After("gorm:commit_or_rollback_transaction").Register("nice:tenant_after_create", after),
+		cb.Query().Before("gorm:query").Register("nice:tenant_before_query", before),
+		cb.Query().After("gorm:query").Register("nice:tenant_after_query", after),
+		cb.Update().Before("gorm:begin_transaction").Register("nice:tenant_before_update", before),
+		cb.Update().After("gorm:commit_or_rollback_transaction").Register("nice:tenant_after_update", after),
+		cb.Delete().Before("gorm:begin_transaction").Register("nice:tenant_before_delete", before),
+		cb.Delete().After("gorm:commit_or_rollback_transaction").Register("nice:tenant_after_delete", after),
+		cb.Row().Before("gorm:row").Register("nice:tenant_before_row", before),
+		cb.Row().After("gorm:row").Register("nice:tenant_after_row", after),
+		cb.Raw().Before("gorm:raw").Register("nice:tenant_before_raw", before),
+		cb.Raw().After("gorm:raw").Register("nice:tenant_after_raw", after),
+	)
+}
+
+type tenantRouter struct {
+	app      *App
+	conf     *TenantConf
+	base     string
+	baseConf *MysqlConf
+	driver   DBDriver
+	idle     time.Duration
+	lock     sync.Mutex
+	pools    map[string]*tenantPool
+	opening  singleflight.Group
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func newTenantRouter(a *App, conf *TenantConf) (*tenantRouter, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	base := conf.BasePool
+	if base == "" {
+		base = "default"
+	}
+	for tenant, node := range conf.List {
+		if node.Pool == "" {
+			continue
+		}
+		if node.Schema != "" || node.DataSourceName != "" {
+			return nil, fmt.Errorf("tenant %v: pool conflicts with schema/data_source_name", tenant)
+		}
+		if _, ok := a.GORMMapPool[node.Pool]; !ok {
+			return nil, fmt.Errorf("tenant %v: unknown pool %v", tenant, node.Pool)
+		}
+	}
+	r := &tenantRouter{app: a, conf: conf, base: base, idle: DefaultTenantIdleTimeout, pools: map[string]*tenantPool{}}
+	if conf.IdleTimeout != nil {
+		r.idle = time.Duration(*conf.IdleTimeout) * time.Second
+	}
+	if baseConf, ok := a.dbConfs[base]; ok {
+		driver, err := GetDBDriver(baseConf.DriverName)
+		if err != nil {
+			return nil, err
+		}
+		r.baseConf, r.driver = baseConf, driver
+	} else if conf.DataSourceTemplate != "" || len(conf.List) > 0 {
+		return nil, fmt.Errorf("tenants: unknown base_pool %v", base)
+	}
+	return r, nil
+}
+
+func (r *tenantRouter) dataSourceName(tenant string) (string, error) {
+	node := r.conf.List[tenant]
+	if node != nil && node.DataSourceName != "" {
+		return node.DataSourceName, nil
+	}
+	if r.conf.DataSourceTemplate == "" {
+		return "", fmt.Errorf("tenant %v not configured", tenant)
+	}
+	schema := tenant
+	if node != nil && node.Schema != "" {
+		schema = node.Schema
+	}
+	return strings.ReplaceAll(r.conf.DataSourceTemplate, "{tenant}", schema), nil
+}
+
+func (r *tenantRouter) db(ctx context.Context, tenant string) (*gorm.DB, error) {
+	if node := r.conf.List[tenant]; node != nil && node.Pool != "" {
+		return r.app.GetGormPool(node.Pool)
+	}
+	if p := r.cached(tenant); p != nil {
+		return p.db, nil
+	}
+	if r.baseConf == nil {
+		return nil, fmt.Errorf("tenant %v not configured", tenant)
+	}
+	dsn, err := r.dataSourceName(tenant)
+	if err != nil {
+		return nil, err
+	}
+	// 建连和ping不持有r.lock,同一租户的并发请求只打开一次
+	v, err, _ := r.opening.Do(tenant, func() (interface{}, error) {
+		if p := r.cached(tenant); p != nil {
+			return p, nil
+		}
+		p, err := r.open(ctx, tenant, dsn)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %v:%w", tenant, err)
+		}
+		r.lock.Lock()
+		if r.pools == nil {
+			r.lock.Unlock()
+			p.pool.Close()
+			return nil, fmt.Errorf("tenant %v: router closed", tenant)
+		}
+		r.pools[tenant] = p
+		r.lock.Unlock()
+		r.app.Log.TagInfo(GetTraceContext(ctx), NLTagMySqlTenant, map[string]interface{}{
+			"event":  "open",
+			"tenant": tenant,
+		})
+		return p, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*tenantPool).db, nil
+}
+
+func (r *tenantRouter) cached(tenant string) *tenantPool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p, ok := r.pools[tenant]
+	if !ok {
+		return nil
+	}
+	p.touch()
+	return p
+}
+
+// 按base_pool的配置打开租户连接池,数据库不可用时返回错误,下次请求重试
+func (r *tenantRouter) open(ctx context.Context, tenant, dsn string) (*tenantPool, error) {
+	conf := *r.baseConf
+	conf.DataSourceName = dsn
+	pool, err := openDBPool(r.driver, &conf, dsn)
+	if err != nil {
+		return nil, err
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, DBHealthCheckTimeout)
+	defer cancel()
+	if err := pool.PingContext(pingCtx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	name := "tenant." + tenant
+	gormLogger, err := r.app.poolLogger(r.base)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	gormLogger.pool = name
+	db, _, err := r.app.openGorm(name, gormLogger, r.driver.Dialector(pool), &conf)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	p := &tenantPool{db: db, pool: pool}
+	p.touch()
+	if err := p.register(); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// 关闭空闲超过idle_timeout且没有执行中语句的懒加载连接池
+func (r *tenantRouter) evict(now time.Time) {
+	r.lock.Lock()
+	var closed []*tenantPool
+	for tenant, p := range r.pools {
+		if p.inflight.Load() > 0 || p.idle(now) < r.idle {
+			continue
+		}
+		delete(r.pools, tenant)
+		closed = append(closed, p)
+		r.app.Log.TagInfo(NewTrace(), NLTagMySqlTenant, map[string]interface{}{
+			"event":  "evict",
+			"tenant": tenant,
+			"idle":   p.idle(now).Seconds(),
+		})
+	}
+	r.lock.Unlock()
+	for _, p := range closed {
+		p.pool.Close()
+	}
+}
+
+func (r *tenantRouter) start() {
+	if r == nil || r.idle <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for sleepCtx(ctx, TenantEvictInterval) {
+			r.evict(time.Now())
+		}
+	}()
+}
+
+func (r *tenantRouter) stop() {
+	if r == nil {
+		return
+	}
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.wg.Wait()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, p := range r.pools {
+		p.pool.Close()
+	}
+	r.pools = nil
+}
+
+// 按ctx中的租户返回对应连接池的*gorm.DB,独立实例/schema的连接池在首次使用时创建,空闲超时后关闭,
+// 返回值应按请求获取,不要长期持有
+func TenantDB(ctx context.Context) (*gorm.DB, error) {
+	return defaultApp.TenantDB(ctx)
+}
+
+func (a *App) TenantDB(ctx context.Context) (*gorm.DB, error) {
+	if a.dbTenants == nil {
+		return nil, errors.New("tenants not configured")
+	}
+	resolver := TenantResolver(defaultTenantResolver)
+	if p := a.tenantResolver.Load(); p != nil {
+		resolver = *p
+	}
+	tenant, err := resolver(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !tenantIdRegexp.MatchString(tenant) {
+		return nil, fmt.Errorf("invalid tenant id %q", tenant)
+	}
+	db, err := a.dbTenants.db(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	return db.WithContext(ctx), nil
+}
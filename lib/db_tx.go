@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+	"math/rand"
+	"time"
+)
+
+var (
+	// 死锁/锁等待超时后的最大重试次数
+	TxMaxRetries       = 3
+	TxRetryMinInterval = 50 * time.Millisecond
+	TxRetryMaxInterval = time.Second
+)
+
+// 在主库事务中执行fn: 返回nil提交,返回错误或panic回滚,死锁(1213)和锁等待超时(1205)按退避重试
+// fn可能被执行多次,不要在其中做事务外的副作用
+func WithTx(ctx context.Context, poolName string, fn func(tx *gorm.DB) error) error {
+	return defaultApp.WithTx(ctx, poolName, fn)
+}
+
+func (a *App) WithTx(ctx context.Context, poolName string, fn func(tx *gorm.DB) error) error {
+	db, err := a.GetGormPool(poolName)
+	if err != nil {
+		return err
+	}
+	trace := GetTraceContext(ctx)
+	start := time.Now()
+	interval := TxRetryMinInterval
+	for attempt := 1; ; attempt++ {
+		err = a.runTx(ctx, trace, db, poolName, attempt, fn)
+		if err == nil || !IsTxRetryable(err) || attempt > TxMaxRetries {
+			break
+		}
+		a.Log.TagWarn(trace, NLTagMySqlTx, map[string]interface{}{
+			"event":     "retry",
+			"pool":      poolName,
+			"attempt":   attempt,
+			"err":       err.Error(),
+			"proc_time": time.Since(start).Seconds(),
+		})
+		if !sleepCtx(ctx, interval/2+time.Duration(rand.Int63n(int64(interval/2)+1))) {
+			return errors.Join(err, ctx.Err())
+		}
+		if interval *= 2; interval > TxRetryMaxInterval {
+			interval = TxRetryMaxInterval
+		}
+	}
+	return err
+}
+
+// 死锁和锁等待超时可以整体重试事务
+func IsTxRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	}
+	return false
+}
+
+func (a *App) runTx(ctx context.Context, trace *TraceContext, db *gorm.DB, poolName string, attempt int, fn func(tx *gorm.DB) error) (err error) {
+	start := time.Now()
+	msg := func(event string) map[string]interface{} {
+		return map[string]interface{}{
+			"event":     event,
+			"pool":      poolName,
+			"attempt":   attempt,
+			"proc_time": time.Since(start).Seconds(),
+		}
+	}
+	tx := db.WithContext(ctx).Begin()
+	if tx.Error != nil {
+		m := msg("begin")
+		m["err"] = tx.Error.Error()
+		a.Log.TagError(trace, NLTagMySqlTx, m)
+		return tx.Error
+	}
+	a.Log.TagInfo(trace, NLTagMySqlTx, msg("begin"))
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			m := msg("rollback")
+			m["panic"] = r
+			a.Log.TagError(trace, NLTagMySqlTx, m)
+			panic(r)
+		}
+	}()
+	if err = fn(tx); err != nil {
+		m := msg("rollback")
+		m["err"] = err.Error()
+		if rbErr := tx.Rollback().Error; rbErr != nil {
+			m["rollback_err"] = rbErr.Error()
+		}
+		a.Log.TagWarn(trace, NLTagMySqlTx, m)
+		return err
+	}
+	if err = tx.Commit().Error; err != nil {
+		m := msg("commit")
+		m["err"] = err.Error()
+		a.Log.TagError(trace, NLTagMySqlTx, m)
+		return err
+	}
+	a.Log.TagInfo(trace, NLTagMySqlTx, msg("commit"))
+	return nil
+}
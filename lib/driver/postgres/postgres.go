@@ -0,0 +1,19 @@
+// 注册postgres驱动(基于pgx),driver_name为postgres/pgx
+//
+//	import _ "github.com/m17621679833/nice_base/lib/driver/postgres"
+package postgres
+
+import (
+	"database/sql"
+	"github.com/m17621679833/nice_base/lib"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func init() {
+	driver := lib.DBDriver{SQLDriver: "pgx", Dialector: func(pool *sql.DB) gorm.Dialector {
+		return postgres.New(postgres.Config{Conn: pool})
+	}}
+	lib.RegisterDBDriver("postgres", driver)
+	lib.RegisterDBDriver("pgx", driver)
+}
@@ -0,0 +1,19 @@
+// 注册sqlite驱动(基于cgo的mattn/go-sqlite3),driver_name为sqlite/sqlite3
+//
+//	import _ "github.com/m17621679833/nice_base/lib/driver/sqlite"
+package sqlite
+
+import (
+	"database/sql"
+	"github.com/m17621679833/nice_base/lib"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func init() {
+	driver := lib.DBDriver{SQLDriver: "sqlite3", Dialector: func(pool *sql.DB) gorm.Dialector {
+		return sqlite.New(sqlite.Config{Conn: pool})
+	}}
+	lib.RegisterDBDriver("sqlite", driver)
+	lib.RegisterDBDriver("sqlite3", driver)
+}
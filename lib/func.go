@@ -2,11 +2,10 @@ package lib
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
-	"flag"
 	"fmt"
-	"github.com/m17621679833/nice_base/nlog"
 	"io"
 	"log"
 	"math/rand"
@@ -22,51 +21,44 @@ func Init(configPath string) error {
 	return InitModule(configPath, []string{"base", "mysql", "redis"})
 }
 
+// configPath为空时使用Configure(WithConfigPath(...))指定的路径,可被$NICE_CONFIG和-config覆盖
 func InitModule(configPath string, modules []string) error {
-	conf := flag.String("config", configPath, "input config file like ./conf/dev/")
-	flag.Parse()
-	if *conf == "" {
-		flag.Usage()
-		os.Exit(1)
+	if configPath == "" {
+		configPath = defaultApp.configPath
 	}
+	return defaultApp.initFileModule(configPath, modules)
+}
 
+// 使用远程配置源代替本地配置目录初始化模块
+func InitModuleWithProvider(provider ConfigProvider, modules []string) error {
+	if err := ParseConfigPath(provider.Path() + "/"); err != nil {
+		return err
+	}
+	return defaultApp.initModule(provider, modules)
+}
+
+func (a *App) initModule(provider ConfigProvider, modules []string) error {
 	log.Println("-------------------------------------------------")
-	log.Printf("[INFO] config=%s\n", *conf)
+	log.Printf("[INFO] config=%s\n", provider.Path())
 	log.Printf("[INFO]%s\n", "start loading resources.")
 	ips := GetLocalIPs()
 	if len(ips) > 0 {
 		LocalIP = ips[0]
 	}
-	if err := ParseConfigPath(*conf); err != nil {
-		return err
-	}
 
-	if err := InitViperConf(); err != nil {
+	snapshot, err := provider.Load(context.Background())
+	if err != nil {
 		return err
 	}
-
-	if InArrayString("base", modules) {
-		if err := InitBaseConf(GetConfPath("base")); err != nil {
-			fmt.Printf("[ERROR] %s%s\n", time.Now().Format(TimeFormat), " Init base conf:"+err.Error())
-		}
-	}
-
-	if InArrayString("redis", modules) {
-		if err := InitRedisConf(GetConfPath("redis_map")); err != nil {
-			fmt.Printf("[ERROR] %s%s\n", time.Now().Format(TimeFormat), " Init redis conf:"+err.Error())
-		}
-	}
-
-	if InArrayString("mysql", modules) {
-		if err := InitDBPool(GetConfPath("mysql_map")); err != nil {
-			fmt.Printf("[ERROR]%s%s\n", time.Now().Format(TimeFormat), "Init mysql conf:"+err.Error())
-		}
+	if err := a.setConfSnapshot(snapshot); err != nil {
+		return err
 	}
+	a.confLock.Lock()
+	a.confProvider = provider
+	a.confLock.Unlock()
 
-	if location, err := time.LoadLocation(ConfBase.TimeLocation); err != nil {
+	if err := a.initModules(context.Background(), modules); err != nil {
 		return err
-	} else {
-		TimeLocation = location
 	}
 
 	log.Printf("[INFO] %s\n", " success loading resources.")
@@ -75,16 +67,28 @@ func InitModule(configPath string, modules []string) error {
 }
 
 func GetConfPath(fileName string) string {
-	return ConfEnvPath + "/" + fileName + ".toml"
+	return defaultApp.GetConfPath(fileName)
+}
+
+func (a *App) GetConfPath(fileName string) string {
+	return a.ConfEnvPath + "/" + fileName + ".toml"
 }
 
 /*
 ./conf/dev/
 */
 func ParseConfigPath(config string) error {
+	return defaultApp.ParseConfigPath(config)
+}
+
+func (a *App) ParseConfigPath(config string) error {
 	path := strings.Split(config, "/")
-	ConfEnvPath = strings.Join(path[:len(path)-1], "/")
-	ConfEnv = path[len(path)-2]
+	if len(path) < 2 {
+		return fmt.Errorf("invalid config path %v, like ./conf/dev/", config)
+	}
+	a.ConfEnvPath = strings.Join(path[:len(path)-1], "/")
+	a.ConfEnv = path[len(path)-2]
+	a.publish()
 	return nil
 }
 
@@ -156,10 +160,15 @@ func InArrayString(s string, arr []string) bool {
 }
 
 func Destroy() {
+	defaultApp.Destroy()
+}
+
+func (a *App) Destroy() {
 	log.Println("------------------------------------------------------------------------")
 	log.Printf("[INFO] %s\n", " start destroy resources.")
-	CloseDB()
-	nlog.Close()
+	if err := a.Shutdown(context.Background()); err != nil {
+		log.Printf("[ERROR] %s\n", err.Error())
+	}
 	log.Printf("[INFO] %s\n", " success destroy resources.")
 }
 
@@ -7,18 +7,29 @@ import (
 )
 
 const (
-	NLTagUndefined     = "_undef"
-	NLTagMySqlFailed   = "_com_mysql_failure"
-	NLTagRedisFailed   = "_com_redis_failure"
-	NLTagMySqlSuccess  = "_com_mysql_success"
-	NLTagRedisSuccess  = "_com_redis_success"
-	NLTagThriftFailed  = "_com_thrift_failure"
-	NLTagThriftSuccess = "_com_thrift_success"
-	NLTagHTTPSuccess   = "_com_http_success"
-	NLTagHTTPFailed    = "_com_http_failure"
-	NLTagTCPFailed     = "_com_tcp_failure"
-	NLTagRequestIn     = "_com_request_in"
-	NLTagRequestOut    = "_com_request_out"
+	NLTagUndefined       = "_undef"
+	NLTagMySqlFailed     = "_com_mysql_failure"
+	NLTagRedisFailed     = "_com_redis_failure"
+	NLTagMySqlSuccess    = "_com_mysql_success"
+	NLTagMySqlSlow       = "_com_mysql_slow"
+	NLTagMySqlInfo       = "_com_mysql_Info"
+	NLTagMySqlWarn       = "_com_mysql_Warn"
+	NLTagMySqlError      = "_com_mysql_Error"
+	NLTagMySqlHealth     = "_com_mysql_health"
+	NLTagMySqlTx         = "_com_mysql_tx"
+	NLTagMySqlSlowReport = "_com_mysql_slow_report"
+	NLTagMySqlMigrate    = "_com_mysql_migrate"
+	NLTagMySqlBreaker    = "_com_mysql_breaker"
+	NLTagMySqlAudit      = "_com_mysql_audit"
+	NLTagMySqlTenant     = "_com_mysql_tenant"
+	NLTagRedisSuccess    = "_com_redis_success"
+	NLTagThriftFailed    = "_com_thrift_failure"
+	NLTagThriftSuccess   = "_com_thrift_success"
+	NLTagHTTPSuccess     = "_com_http_success"
+	NLTagHTTPFailed      = "_com_http_failure"
+	NLTagTCPFailed       = "_com_tcp_failure"
+	NLTagRequestIn       = "_com_request_in"
+	NLTagRequestOut      = "_com_request_out"
 )
 const (
 	_nlTag          = "nltag"
@@ -32,6 +43,12 @@ const (
 var Log *LoggerFaced
 
 type LoggerFaced struct {
+	logger *nlog.Logger
+}
+
+// 使用独立日志实例的LoggerFaced,logger为nil时写入nlog默认日志
+func NewLoggerFaced(logger *nlog.Logger) *LoggerFaced {
+	return &LoggerFaced{logger: logger}
 }
 
 func (l *LoggerFaced) TagInfo(trace *TraceContext, nltag string, m map[string]interface{}) {
@@ -39,6 +56,10 @@ func (l *LoggerFaced) TagInfo(trace *TraceContext, nltag string, m map[string]in
 	m[_traceId] = trace.TraceId
 	m[_childSpanId] = trace.CSpanId
 	m[_spanId] = trace.SpanId
+	if l != nil && l.logger != nil {
+		l.logger.Info(parseParams(m))
+		return
+	}
 	nlog.Info(parseParams(m))
 }
 
@@ -47,6 +68,10 @@ func (l *LoggerFaced) TagWarn(trace *TraceContext, nltag string, m map[string]in
 	m[_traceId] = trace.TraceId
 	m[_childSpanId] = trace.CSpanId
 	m[_spanId] = trace.SpanId
+	if l != nil && l.logger != nil {
+		l.logger.Warn(parseParams(m))
+		return
+	}
 	nlog.Warn(parseParams(m))
 }
 
@@ -55,6 +80,10 @@ func (l *LoggerFaced) TagError(trace *TraceContext, nltag string, m map[string]i
 	m[_traceId] = trace.TraceId
 	m[_childSpanId] = trace.CSpanId
 	m[_spanId] = trace.SpanId
+	if l != nil && l.logger != nil {
+		l.logger.Error(parseParams(m))
+		return
+	}
 	nlog.Error(parseParams(m))
 }
 
@@ -63,6 +92,10 @@ func (l *LoggerFaced) TagTrace(trace *TraceContext, nltag string, m map[string]i
 	m[_traceId] = trace.TraceId
 	m[_childSpanId] = trace.CSpanId
 	m[_spanId] = trace.SpanId
+	if l != nil && l.logger != nil {
+		l.logger.Trace(parseParams(m))
+		return
+	}
 	nlog.Trace(parseParams(m))
 }
 
@@ -71,10 +104,18 @@ func (l *LoggerFaced) TagDebug(trace *TraceContext, nltag string, m map[string]i
 	m[_traceId] = trace.TraceId
 	m[_childSpanId] = trace.CSpanId
 	m[_spanId] = trace.SpanId
+	if l != nil && l.logger != nil {
+		l.logger.Debug(parseParams(m))
+		return
+	}
 	nlog.Debug(parseParams(m))
 }
 
 func (l *LoggerFaced) Close() {
+	if l != nil && l.logger != nil {
+		l.logger.Close()
+		return
+	}
 	nlog.Close()
 }
 
@@ -0,0 +1,488 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"gorm.io/gorm"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// 等待其他实例释放迁移锁的最长时间
+	MigrateLockTimeout = time.Minute
+	// 超过该时间未刷新的锁视为持有者已崩溃,可以抢占
+	MigrateLockTTL = 10 * time.Minute
+	// 持有锁期间刷新locked_at的间隔,需小于MigrateLockTTL
+	MigrateLockHeartbeat = time.Minute
+
+	ErrMigrateLocked = errors.New("migration lock held by another instance")
+
+	migrationFileRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+)
+
+// 版本化迁移,Up/Down为空时执行UpSQL/DownSQL;MySQL的DDL会隐式提交,失败时可能需要人工处理
+type Migration struct {
+	Version int64
+	Name    string
+	UpSQL   string
+	DownSQL string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+type MigrationStatus struct {
+	Pool      string     `json:"pool"`
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+type schemaMigration struct {
+	Version   int64  `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"size:255"`
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+type schemaMigrationLock struct {
+	ID       int    `gorm:"primaryKey;autoIncrement:false"`
+	LockedBy string `gorm:"size:255"`
+	LockedAt time.Time
+}
+
+func (schemaMigrationLock) TableName() string {
+	return "schema_migrations_lock"
+}
+
+type migrationRegistry struct {
+	lock       sync.Mutex
+	migrations map[string]map[int64]*Migration
+}
+
+// 为连接池注册Go函数形式的迁移,版本重复时报错
+func RegisterMigration(pool string, m Migration) error {
+	return defaultApp.RegisterMigration(pool, m)
+}
+
+func (a *App) RegisterMigration(pool string, m Migration) error {
+	if m.Up == nil && m.UpSQL == "" {
+		return fmt.Errorf("migration %v_%v has no up step", m.Version, m.Name)
+	}
+	a.migrations.lock.Lock()
+	defer a.migrations.lock.Unlock()
+	if a.migrations.migrations == nil {
+		a.migrations.migrations = map[string]map[int64]*Migration{}
+	}
+	if a.migrations.migrations[pool] == nil {
+		a.migrations.migrations[pool] = map[int64]*Migration{}
+	}
+	if _, ok := a.migrations.migrations[pool][m.Version]; ok {
+		return fmt.Errorf("duplicate migration version %v for pool %v", m.Version, pool)
+	}
+	a.migrations.migrations[pool][m.Version] = &m
+	return nil
+}
+
+// 从目录加载 <版本>_<名称>.up.sql / .down.sql,可配合embed.FS使用
+func LoadMigrations(pool string, fsys fs.FS) error {
+	return defaultApp.LoadMigrations(pool, fsys)
+}
+
+func (a *App) LoadMigrations(pool string, fsys fs.FS) error {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+	files := map[int64]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("migration %v:%w", entry.Name(), err)
+		}
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return err
+		}
+		m, ok := files[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			files[version] = m
+		} else if m.Name != match[2] {
+			return fmt.Errorf("migration version %v has different names %v and %v", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.UpSQL = string(data)
+		} else {
+			m.DownSQL = string(data)
+		}
+	}
+	for _, m := range files {
+		if err := a.RegisterMigration(pool, *m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *App) poolMigrations(pool string) []*Migration {
+	a.migrations.lock.Lock()
+	defer a.migrations.lock.Unlock()
+	list := make([]*Migration, 0, len(a.migrations.migrations[pool]))
+	for _, m := range a.migrations.migrations[pool] {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list
+}
+
+func (a *App) migrationPools() []string {
+	a.migrations.lock.Lock()
+	defer a.migrations.lock.Unlock()
+	pools := make([]string, 0, len(a.migrations.migrations))
+	for pool := range a.migrations.migrations {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+	return pools
+}
+
+// 执行所有未应用的迁移
+func MigrateUp(ctx context.Context, pool string) error {
+	return defaultApp.MigrateUp(ctx, pool)
+}
+
+func (a *App) MigrateUp(ctx context.Context, pool string) error {
+	return a.withMigrationLock(ctx, pool, func(db *gorm.DB) error {
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return err
+		}
+		for _, m := range a.poolMigrations(pool) {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			start := time.Now()
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := m.runUp(tx); err != nil {
+					return err
+				}
+				return tx.Create(&schemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			})
+			a.logMigration(ctx, pool, "up", m, start, err)
+			if err != nil {
+				return fmt.Errorf("migrate %v up %v_%v:%w", pool, m.Version, m.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// 按版本倒序回滚最近steps个已应用的迁移
+func MigrateDown(ctx context.Context, pool string, steps int) error {
+	return defaultApp.MigrateDown(ctx, pool, steps)
+}
+
+func (a *App) MigrateDown(ctx context.Context, pool string, steps int) error {
+	if steps <= 0 {
+		return fmt.Errorf("migrate %v down: steps must be positive, got %d", pool, steps)
+	}
+	return a.withMigrationLock(ctx, pool, func(db *gorm.DB) error {
+		var rows []schemaMigration
+		if err := db.Order("version desc").Limit(steps).Find(&rows).Error; err != nil {
+			return err
+		}
+		known := map[int64]*Migration{}
+		for _, m := range a.poolMigrations(pool) {
+			known[m.Version] = m
+		}
+		for _, row := range rows {
+			m, ok := known[row.Version]
+			if !ok || (m.Down == nil && m.DownSQL == "") {
+				return fmt.Errorf("migrate %v down %v_%v: no down step", pool, row.Version, row.Name)
+			}
+			start := time.Now()
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := m.runDown(tx); err != nil {
+					return err
+				}
+				return tx.Delete(&schemaMigration{}, "version = ?", m.Version).Error
+			})
+			a.logMigration(ctx, pool, "down", m, start, err)
+			if err != nil {
+				return fmt.Errorf("migrate %v down %v_%v:%w", pool, m.Version, m.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// 已注册迁移和数据库中已应用记录的合并视图,按版本排序
+func MigrationStatuses(ctx context.Context, pool string) ([]MigrationStatus, error) {
+	return defaultApp.MigrationStatuses(ctx, pool)
+}
+
+func (a *App) MigrationStatuses(ctx context.Context, pool string) ([]MigrationStatus, error) {
+	db, err := a.migrationDB(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	for _, m := range a.poolMigrations(pool) {
+		status := MigrationStatus{Pool: pool, Version: m.Version, Name: m.Name}
+		if row, ok := applied[m.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = &row.AppliedAt
+			delete(applied, m.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, row := range applied {
+		row := row
+		statuses = append(statuses, MigrationStatus{Pool: pool, Version: row.Version, Name: row.Name, Applied: true, AppliedAt: &row.AppliedAt})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+func (m *Migration) runUp(tx *gorm.DB) error {
+	if m.Up != nil {
+		return m.Up(tx)
+	}
+	return execMigrationSQL(tx, m.UpSQL)
+}
+
+func (m *Migration) runDown(tx *gorm.DB) error {
+	if m.Down != nil {
+		return m.Down(tx)
+	}
+	return execMigrationSQL(tx, m.DownSQL)
+}
+
+func execMigrationSQL(tx *gorm.DB, script string) error {
+	for _, stmt := range splitSQLStatements(script) {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按分号拆分多条语句,忽略引号和注释中的分号;存储过程等复杂语句请使用Go函数迁移
+func splitSQLStatements(script string) []string {
+	var stmts []string
+	var b strings.Builder
+	flush := func() {
+		if stmt := strings.TrimSpace(b.String()); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+		b.Reset()
+	}
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(script) && script[end] != c {
+				if script[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(script) {
+				end = len(script) - 1
+			}
+			b.WriteString(script[i : end+1])
+			i = end
+		case c == '-' && strings.HasPrefix(script[i:], "--"), c == '#':
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+			b.WriteByte('\n')
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end + 3
+			}
+		case c == ';':
+			flush()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	flush()
+	return stmts
+}
+
+func appliedMigrations(db *gorm.DB) (map[int64]schemaMigration, error) {
+	var rows []schemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]schemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+func (a *App) migrationDB(ctx context.Context, pool string) (*gorm.DB, error) {
+	db, err := a.GetGormPool(pool)
+	if err != nil {
+		return nil, err
+	}
+	db = UsePrimary(db.WithContext(ctx)).Session(&gorm.Session{})
+	if err := db.AutoMigrate(&schemaMigration{}, &schemaMigrationLock{}); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// 通过schema_migrations_lock表的主键冲突保证同一时间只有一个实例执行迁移
+func (a *App) withMigrationLock(ctx context.Context, pool string, fn func(db *gorm.DB) error) error {
+	db, err := a.migrationDB(ctx, pool)
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%v:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+	deadline := time.Now().Add(MigrateLockTimeout)
+	for {
+		err := db.Create(&schemaMigrationLock{ID: 1, LockedBy: owner, LockedAt: time.Now()}).Error
+		if err == nil {
+			break
+		}
+		var lock schemaMigrationLock
+		if db.First(&lock, "id = ?", 1).Error == nil && time.Since(lock.LockedAt) > MigrateLockTTL {
+			// 读取后持有者可能刚刷新了锁,只删除未变化的过期锁
+			result := db.Delete(&schemaMigrationLock{}, "id = ? AND locked_by = ? AND locked_at = ?", 1, lock.LockedBy, lock.LockedAt)
+			if result.Error == nil && result.RowsAffected > 0 {
+				continue
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %v", ErrMigrateLocked, lock.LockedBy)
+		}
+		if !sleepCtx(ctx, 500*time.Millisecond) {
+			return ctx.Err()
+		}
+	}
+	defer db.Delete(&schemaMigrationLock{}, "id = ? AND locked_by = ?", 1, owner)
+
+	// 迁移耗时可能超过MigrateLockTTL,持有期间定期刷新避免被其他实例抢占
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(MigrateLockHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				db.Model(&schemaMigrationLock{}).Where("id = ? AND locked_by = ?", 1, owner).Update("locked_at", time.Now())
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(stop)
+	return fn(db)
+}
+
+func (a *App) logMigration(ctx context.Context, pool, direction string, m *Migration, start time.Time, err error) {
+	msg := map[string]interface{}{
+		"pool":      pool,
+		"direction": direction,
+		"version":   m.Version,
+		"name":      m.Name,
+		"proc_time": fmt.Sprintf("%f", time.Since(start).Seconds()),
+	}
+	if err != nil {
+		msg["err"] = err.Error()
+		a.Log.TagError(GetTraceContext(ctx), NLTagMySqlMigrate, msg)
+		return
+	}
+	a.Log.TagInfo(GetTraceContext(ctx), NLTagMySqlMigrate, msg)
+}
+
+// InitModule初始化mysql模块后执行已注册的待应用迁移
+func WithAutoMigrate() Option {
+	return func(a *App) {
+		a.autoMigrate = true
+	}
+}
+
+func (a *App) runAutoMigrate(ctx context.Context) error {
+	if !a.autoMigrate {
+		return nil
+	}
+	for _, pool := range a.migrationPools() {
+		if err := a.MigrateUp(ctx, pool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 迁移子命令: up | down [-steps n] | status,供业务程序嵌入自己的命令行
+func RunMigrateCommand(ctx context.Context, args []string, out io.Writer) error {
+	return defaultApp.RunMigrateCommand(ctx, args, out)
+}
+
+func (a *App) RunMigrateCommand(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	pool := fs.String("pool", "default", "db pool name in mysql_map.toml")
+	steps := fs.Int("steps", 1, "number of migrations to roll back")
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down|status [-pool name] [-steps n]")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	switch args[0] {
+	case "up":
+		return a.MigrateUp(ctx, *pool)
+	case "down":
+		return a.MigrateDown(ctx, *pool, *steps)
+	case "status":
+		statuses, err := a.MigrationStatuses(ctx, *pool)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %v", args[0])
+}
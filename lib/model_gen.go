@@ -0,0 +1,363 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var importVersionRegexp = regexp.MustCompile(`^v\d+$`)
+
+// 数据表结构,用于生成gorm模型
+type ModelTable struct {
+	Name    string
+	Comment string
+	Columns []ModelColumn
+}
+
+type ModelColumn struct {
+	Name          string `db:"column_name"`
+	Type          string `db:"column_type"`
+	Nullable      string `db:"is_nullable"`
+	Key           string `db:"column_key"`
+	Extra         string `db:"extra"`
+	Comment       string `db:"column_comment"`
+	PrimaryKey    bool   `db:"-"`
+	AutoIncrement bool   `db:"-"`
+}
+
+// 读取连接池对应库的表结构,tables/excludes为表名通配符(path.Match),tables为空表示全部
+func LoadModelTables(ctx context.Context, pool string, tables, excludes []string) ([]ModelTable, error) {
+	return defaultApp.LoadModelTables(ctx, pool, tables, excludes)
+}
+
+func (a *App) LoadModelTables(ctx context.Context, pool string, tables, excludes []string) ([]ModelTable, error) {
+	db, err := a.GetGormPool(pool)
+	if err != nil {
+		return nil, err
+	}
+	ctx = PrimaryContext(ctx)
+	var listSQL, columnSQL string
+	dialect := db.Dialector.Name()
+	switch dialect {
+	case "mysql":
+		listSQL = "SELECT table_name AS name, table_comment AS comment FROM information_schema.tables " +
+			"WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE' ORDER BY table_name"
+		columnSQL = "SELECT column_name AS column_name, column_type AS column_type, is_nullable AS is_nullable, " +
+			"column_key AS column_key, extra AS extra, column_comment AS column_comment FROM information_schema.columns " +
+			"WHERE table_schema = DATABASE() AND table_name = ? ORDER BY ordinal_position"
+	case "sqlite":
+		listSQL = "SELECT name, '' AS comment FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name"
+		columnSQL = "SELECT name AS column_name, type AS column_type, CASE WHEN \"notnull\" = 0 AND pk = 0 THEN 'YES' ELSE 'NO' END AS is_nullable, " +
+			"CASE WHEN pk > 0 THEN 'PRI' ELSE '' END AS column_key, " +
+			"CASE WHEN pk = 1 AND lower(type) = 'integer' THEN 'auto_increment' ELSE '' END AS extra, '' AS column_comment " +
+			"FROM pragma_table_info(?) ORDER BY cid"
+	default:
+		return nil, fmt.Errorf("model generation does not support %v", dialect)
+	}
+
+	type tableRow struct {
+		Name    string `db:"name"`
+		Comment string `db:"comment"`
+	}
+	rows, err := AppDBQueryStructs[tableRow](a, ctx, pool, listSQL)
+	if err != nil {
+		return nil, err
+	}
+	var result []ModelTable
+	for _, row := range rows {
+		if !matchTableName(row.Name, tables, true) || matchTableName(row.Name, excludes, false) {
+			continue
+		}
+		columns, err := AppDBQueryStructs[ModelColumn](a, ctx, pool, columnSQL, row.Name)
+		if err != nil {
+			return nil, err
+		}
+		for i := range columns {
+			columns[i].PrimaryKey = columns[i].Key == "PRI"
+			columns[i].AutoIncrement = strings.Contains(strings.ToLower(columns[i].Extra), "auto_increment")
+		}
+		result = append(result, ModelTable{Name: row.Name, Comment: row.Comment, Columns: columns})
+	}
+	return result, nil
+}
+
+func matchTableName(name string, patterns []string, empty bool) bool {
+	if len(patterns) == 0 {
+		return empty
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// test_user -> TestUser,与手写模型的 Id/CreatedAt 风格一致
+func ModelStructName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == ' ' }) {
+		runes := []rune(part)
+		runes[0] = unicode.ToUpper(runes[0])
+		b.WriteString(string(runes))
+	}
+	s := b.String()
+	if s == "" || !unicode.IsLetter([]rune(s)[0]) {
+		s = "F" + s
+	}
+	return s
+}
+
+// mysql/sqlite列类型到go类型,可为空的列使用指针
+func modelGoType(column ModelColumn) (string, string) {
+	columnType := strings.ToLower(column.Type)
+	base, _, _ := strings.Cut(columnType, "(")
+	base = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(base), " unsigned"))
+	var goType, pkg string
+	switch base {
+	case "tinyint":
+		// mysql的布尔列为tinyint(1)
+		goType = "int64"
+		if strings.HasPrefix(columnType, "tinyint(1)") {
+			goType = "bool"
+		}
+	case "smallint", "mediumint", "int", "integer", "year":
+		goType = "int64"
+	case "bigint":
+		goType = "int64"
+		if strings.Contains(columnType, "unsigned") {
+			goType = "uint64"
+		}
+	case "bool", "boolean":
+		goType = "bool"
+	case "float", "double", "real":
+		goType = "float64"
+	case "decimal", "numeric":
+		// 定点数用string保留精度
+		goType = "string"
+	case "date", "datetime", "timestamp":
+		goType, pkg = "time.Time", "time"
+	case "blob", "tinyblob", "mediumblob", "longblob", "binary", "varbinary", "bit":
+		return "[]byte", ""
+	default:
+		goType = "string"
+	}
+	if column.Nullable == "YES" {
+		goType = "*" + goType
+	}
+	return goType, pkg
+}
+
+// 生成单个表的模型源码: 结构体和TableName方法
+func GenerateModel(pkg string, table ModelTable) ([]byte, error) {
+	name := ModelStructName(table.Name)
+	imports := map[string]bool{}
+	var fields strings.Builder
+	for _, column := range table.Columns {
+		goType, imp := modelGoType(column)
+		if imp != "" {
+			imports[imp] = true
+		}
+		gormTag := "column:" + column.Name
+		if column.PrimaryKey {
+			gormTag += ";primary_key"
+		}
+		if column.AutoIncrement {
+			gormTag += ";autoIncrement"
+		}
+		fmt.Fprintf(&fields, "\t%s %s `json:\"%s\" gorm:\"%s\"`", ModelStructName(column.Name), goType, column.Name, gormTag)
+		if comment := oneLineComment(column.Comment); comment != "" {
+			fmt.Fprintf(&fields, " // %s", comment)
+		}
+		fields.WriteString("\n")
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	var lines []string
+	for _, imp := range sortedKeys(imports) {
+		lines = append(lines, strconv.Quote(imp))
+	}
+	b.WriteString(importBlock(lines))
+	comment := oneLineComment(table.Comment)
+	if comment == "" {
+		comment = "表" + table.Name
+	}
+	fmt.Fprintf(&b, "// %s %s\ntype %s struct {\n%s}\n\n", name, comment, name, fields.String())
+	fmt.Fprintf(&b, "func (t *%s) TableName() string {\n\treturn %q\n}\n", name, table.Name)
+	return format.Source(b.Bytes())
+}
+
+func importBlock(lines []string) string {
+	switch len(lines) {
+	case 0:
+		return ""
+	case 1:
+		return "import " + lines[0] + "\n\n"
+	}
+	return "import (\n\t" + strings.Join(lines, "\n\t") + "\n)\n\n"
+}
+
+func oneLineComment(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 用新生成的结构体和方法替换已有文件中的同名声明,保留其他自定义代码,并按使用情况重建import
+func MergeModelSource(existing, generated []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(existing)) == 0 {
+		return generated, nil
+	}
+	genSet := token.NewFileSet()
+	genFile, err := parser.ParseFile(genSet, "generated.go", generated, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	oldSet := token.NewFileSet()
+	oldFile, err := parser.ParseFile(oldSet, "existing.go", existing, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	var genDecls []string
+	for _, decl := range genFile.Decls {
+		key, isImport := declKey(decl)
+		if isImport {
+			continue
+		}
+		keys[key] = true
+		start, end := declRange(genSet, decl)
+		genDecls = append(genDecls, string(generated[start:end]))
+	}
+
+	type span struct {
+		start, end int
+		generated  bool
+	}
+	var spans []span
+	for _, decl := range oldFile.Decls {
+		key, isImport := declKey(decl)
+		if isImport || keys[key] {
+			start, end := declRange(oldSet, decl)
+			spans = append(spans, span{start: start, end: end, generated: !isImport})
+		}
+	}
+
+	headerEnd := oldSet.Position(oldFile.Name.End()).Offset
+	var body bytes.Buffer
+	inserted := false
+	last := headerEnd
+	for _, s := range spans {
+		body.Write(existing[last:s.start])
+		if s.generated && !inserted {
+			body.WriteString(strings.Join(genDecls, "\n\n"))
+			inserted = true
+		}
+		last = s.end
+	}
+	body.Write(existing[last:])
+	if !inserted {
+		body.WriteString("\n\n" + strings.Join(genDecls, "\n\n") + "\n")
+	}
+
+	imports, err := usedImports(body.Bytes(), append(oldFile.Imports, genFile.Imports...))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	out.Write(existing[:headerEnd])
+	out.WriteString("\n\n")
+	out.WriteString(importBlock(imports))
+	out.Write(body.Bytes())
+	return format.Source(out.Bytes())
+}
+
+func declKey(decl ast.Decl) (string, bool) {
+	switch d := decl.(type) {
+	case *ast.GenDecl:
+		if d.Tok == token.IMPORT {
+			return "", true
+		}
+		if d.Tok == token.TYPE && len(d.Specs) == 1 {
+			return "type:" + d.Specs[0].(*ast.TypeSpec).Name.Name, false
+		}
+	case *ast.FuncDecl:
+		if d.Recv != nil && len(d.Recv.List) == 1 {
+			recv := d.Recv.List[0].Type
+			if star, ok := recv.(*ast.StarExpr); ok {
+				recv = star.X
+			}
+			if ident, ok := recv.(*ast.Ident); ok {
+				return "func:" + ident.Name + "." + d.Name.Name, false
+			}
+		}
+	}
+	return "", false
+}
+
+// 声明及其文档注释在源码中的范围
+func declRange(fset *token.FileSet, decl ast.Decl) (int, int) {
+	start := decl.Pos()
+	switch d := decl.(type) {
+	case *ast.GenDecl:
+		if d.Doc != nil {
+			start = d.Doc.Pos()
+		}
+	case *ast.FuncDecl:
+		if d.Doc != nil {
+			start = d.Doc.Pos()
+		}
+	}
+	return fset.Position(start).Offset, fset.Position(decl.End()).Offset
+}
+
+func usedImports(body []byte, specs []*ast.ImportSpec) ([]string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), "body.go", append([]byte("package p\n"), body...), 0)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok && ident.Obj == nil {
+				used[ident.Name] = true
+			}
+		}
+		return true
+	})
+	lines := map[string]bool{}
+	for _, spec := range specs {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		name := path.Base(importPath)
+		line := spec.Path.Value
+		if spec.Name != nil {
+			name = spec.Name.Name
+			line = name + " " + spec.Path.Value
+		}
+		// 包名无法从路径推断时保留,如 gopkg.in/yaml.v2、.../v2
+		if used[name] || name == "_" || name == "." || !token.IsIdentifier(name) || importVersionRegexp.MatchString(name) {
+			lines[line] = true
+		}
+	}
+	return sortedKeys(lines), nil
+}
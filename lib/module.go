@@ -0,0 +1,496 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"sync"
+	"time"
+)
+
+// 可插拔模块,InitModule按依赖顺序初始化,Destroy逆序关闭
+type Module interface {
+	Name() string
+	DependsOn() []string
+	Init(ctx context.Context) error
+	HealthCheck(ctx context.Context) error
+	Close() error
+}
+
+// 模块初始化失败时的处理策略
+type ModulePolicy int
+
+const (
+	// 打印告警后继续启动
+	PolicyOptional ModulePolicy = iota
+	// 启动失败,InitModule返回汇总错误
+	PolicyRequired
+	// 后台重试直到初始化成功
+	PolicyRetry
+)
+
+func (p ModulePolicy) String() string {
+	switch p {
+	case PolicyRequired:
+		return "required"
+	case PolicyRetry:
+		return "retry"
+	}
+	return "optional"
+}
+
+type ModuleState string
+
+const (
+	ModuleStatePending  ModuleState = "pending"
+	ModuleStateRunning  ModuleState = "running"
+	ModuleStateRetrying ModuleState = "retrying"
+	ModuleStateFailed   ModuleState = "failed"
+	ModuleStateClosed   ModuleState = "closed"
+)
+
+type ModuleStatus struct {
+	Name      string
+	Policy    ModulePolicy
+	State     ModuleState
+	Attempts  int
+	Err       error
+	UpdatedAt time.Time
+}
+
+var (
+	ModuleRetryMinInterval = time.Second
+	ModuleRetryMaxInterval = 30 * time.Second
+	ModuleCloseTimeout     = 10 * time.Second
+)
+
+// 注册模块,重复注册同名模块会panic
+func RegisterModule(m Module) {
+	defaultApp.RegisterModule(m)
+}
+
+func (a *App) RegisterModule(m Module) {
+	a.moduleLock.Lock()
+	defer a.moduleLock.Unlock()
+	if _, ok := a.moduleRegistry[m.Name()]; ok {
+		panic("module " + m.Name() + " already registered")
+	}
+	a.moduleRegistry[m.Name()] = m
+}
+
+func GetModule(name string) (Module, bool) {
+	return defaultApp.GetModule(name)
+}
+
+func (a *App) GetModule(name string) (Module, bool) {
+	a.moduleLock.Lock()
+	defer a.moduleLock.Unlock()
+	m, ok := a.moduleRegistry[name]
+	return m, ok
+}
+
+// 按依赖关系排序,依赖的模块自动加入且排在前面
+func (a *App) resolveModules(names []string) ([]Module, error) {
+	a.moduleLock.Lock()
+	defer a.moduleLock.Unlock()
+	var sorted []Module
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("module dependency cycle: %v -> %v", path, name)
+		case 2:
+			return nil
+		}
+		m, ok := a.moduleRegistry[name]
+		if !ok {
+			if len(path) > 0 {
+				return fmt.Errorf("module %v depends on unknown module %v", path[len(path)-1], name)
+			}
+			return fmt.Errorf("unknown module %v", name)
+		}
+		state[name] = 1
+		for _, dep := range m.DependsOn() {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		sorted = append(sorted, m)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// 设置模块初始化策略,未设置时base为required,其余为optional
+func SetModulePolicy(name string, policy ModulePolicy) {
+	defaultApp.SetModulePolicy(name, policy)
+}
+
+func (a *App) SetModulePolicy(name string, policy ModulePolicy) {
+	a.moduleLock.Lock()
+	defer a.moduleLock.Unlock()
+	a.modulePolicies[name] = policy
+}
+
+func (a *App) getModulePolicy(name string) ModulePolicy {
+	a.moduleLock.Lock()
+	defer a.moduleLock.Unlock()
+	return a.modulePolicies[name]
+}
+
+// 运行时查询各模块状态
+func ModuleStates() map[string]ModuleStatus {
+	return defaultApp.ModuleStates()
+}
+
+func (a *App) ModuleStates() map[string]ModuleStatus {
+	a.moduleLock.Lock()
+	defer a.moduleLock.Unlock()
+	states := make(map[string]ModuleStatus, len(a.moduleStates))
+	for name, status := range a.moduleStates {
+		states[name] = *status
+	}
+	return states
+}
+
+func (a *App) setModuleState(name string, state ModuleState, err error) {
+	a.moduleLock.Lock()
+	defer a.moduleLock.Unlock()
+	status, ok := a.moduleStates[name]
+	if !ok {
+		status = &ModuleStatus{Name: name}
+		a.moduleStates[name] = status
+	}
+	status.Policy = a.modulePolicies[name]
+	if state == ModuleStateRunning || state == ModuleStateFailed || state == ModuleStateRetrying {
+		status.Attempts++
+	}
+	status.State = state
+	status.Err = err
+	status.UpdatedAt = time.Now()
+}
+
+func (a *App) initModules(ctx context.Context, names []string) error {
+	modules, err := a.resolveModules(names)
+	if err != nil {
+		return err
+	}
+	a.moduleLock.Lock()
+	if a.retryCancel == nil {
+		a.retryCtx, a.retryCancel = context.WithCancel(context.Background())
+	}
+	call := &moduleInitCall{}
+	call.ctx, call.cancel = context.WithCancel(a.retryCtx)
+	a.moduleLock.Unlock()
+
+	var errs []error
+	for _, m := range modules {
+		if a.isModuleInited(m.Name()) {
+			continue
+		}
+		policy := a.getModulePolicy(m.Name())
+		err := a.checkModuleDeps(m)
+		if err == nil {
+			err = m.Init(ctx)
+		}
+		if err == nil {
+			a.markModuleInited(m, call)
+			continue
+		}
+		switch policy {
+		case PolicyRequired:
+			a.setModuleState(m.Name(), ModuleStateFailed, err)
+			errs = append(errs, fmt.Errorf("init module %v:%w", m.Name(), err))
+		case PolicyRetry:
+			a.setModuleState(m.Name(), ModuleStateRetrying, err)
+			fmt.Printf("[WARN] %s Init %s:%s, retry in background\n", time.Now().Format(TimeFormat), m.Name(), err.Error())
+			a.startModuleRetry(m, call)
+		default:
+			a.setModuleState(m.Name(), ModuleStateFailed, err)
+			fmt.Printf("[WARN] %s Init %s:%s\n", time.Now().Format(TimeFormat), m.Name(), err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		a.rollbackModules(ctx, call)
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// 一次initModules调用启动的模块和后台重试,失败时只回滚这些,之前调用已初始化的模块保持运行
+type moduleInitCall struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	started []Module
+}
+
+func (a *App) rollbackModules(ctx context.Context, call *moduleInitCall) {
+	call.cancel()
+	call.wg.Wait()
+	a.moduleLock.Lock()
+	kept := a.initedModules[:0:0]
+	for _, m := range a.initedModules {
+		if !containsModule(call.started, m) {
+			kept = append(kept, m)
+		}
+	}
+	a.initedModules = kept
+	started := call.started
+	call.started = nil
+	a.moduleLock.Unlock()
+	a.closeModuleList(ctx, &ShutdownError{}, started)
+}
+
+func containsModule(modules []Module, m Module) bool {
+	for _, item := range modules {
+		if item == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *App) checkModuleDeps(m Module) error {
+	for _, dep := range m.DependsOn() {
+		if !a.isModuleInited(dep) {
+			return fmt.Errorf("dependency %v not available", dep)
+		}
+	}
+	return nil
+}
+
+func (a *App) markModuleInited(m Module, call *moduleInitCall) {
+	a.moduleLock.Lock()
+	a.initedModules = append(a.initedModules, m)
+	call.started = append(call.started, m)
+	a.moduleLock.Unlock()
+	a.setModuleState(m.Name(), ModuleStateRunning, nil)
+}
+
+// 退避重试模块初始化,Destroy时停止
+func (a *App) startModuleRetry(m Module, call *moduleInitCall) {
+	a.moduleLock.Lock()
+	if a.retryCancel == nil {
+		a.moduleLock.Unlock()
+		return
+	}
+	ctx := call.ctx
+	a.retryWg.Add(1)
+	call.wg.Add(1)
+	a.moduleLock.Unlock()
+	go func() {
+		defer a.retryWg.Done()
+		defer call.wg.Done()
+		interval := ModuleRetryMinInterval
+		for sleepCtx(ctx, interval) {
+			err := a.checkModuleDeps(m)
+			if err == nil {
+				err = m.Init(ctx)
+			}
+			if err == nil {
+				a.markModuleInited(m, call)
+				log.Printf("[INFO] module %s init success after retry\n", m.Name())
+				return
+			}
+			a.setModuleState(m.Name(), ModuleStateRetrying, err)
+			if interval *= 2; interval > ModuleRetryMaxInterval {
+				interval = ModuleRetryMaxInterval
+			}
+		}
+	}()
+}
+
+func (a *App) isModuleInited(name string) bool {
+	a.moduleLock.Lock()
+	defer a.moduleLock.Unlock()
+	for _, m := range a.initedModules {
+		if m.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 停止后台重试并逆序关闭已初始化的模块,base模块(日志)最后关闭
+func (a *App) closeModules(ctx context.Context, report *ShutdownError) {
+	a.moduleLock.Lock()
+	if a.retryCancel != nil {
+		a.retryCancel()
+		a.retryCancel = nil
+	}
+	a.moduleLock.Unlock()
+	a.retryWg.Wait()
+
+	a.moduleLock.Lock()
+	modules := a.initedModules
+	a.initedModules = nil
+	a.moduleLock.Unlock()
+	a.closeModuleList(ctx, report, modules)
+}
+
+func (a *App) closeModuleList(ctx context.Context, report *ShutdownError, modules []Module) {
+	ordered := make([]Module, 0, len(modules))
+	var base Module
+	for i := len(modules) - 1; i >= 0; i-- {
+		if modules[i].Name() == "base" {
+			base = modules[i]
+			continue
+		}
+		ordered = append(ordered, modules[i])
+	}
+	if base != nil {
+		ordered = append(ordered, base)
+	}
+	for _, m := range ordered {
+		m := m
+		err := report.run(ctx, "module:"+m.Name(), ModuleCloseTimeout, func(ctx context.Context) error {
+			return m.Close()
+		})
+		a.setModuleState(m.Name(), ModuleStateClosed, err)
+	}
+}
+
+// 检查所有已初始化模块,返回 模块名 -> 错误(nil表示健康)
+func ModuleHealth(ctx context.Context) map[string]error {
+	return defaultApp.ModuleHealth(ctx)
+}
+
+func (a *App) ModuleHealth(ctx context.Context) map[string]error {
+	a.moduleLock.Lock()
+	modules := a.initedModules
+	a.moduleLock.Unlock()
+	health := make(map[string]error, len(modules))
+	for _, m := range modules {
+		health[m.Name()] = m.HealthCheck(ctx)
+	}
+	return health
+}
+
+type baseModule struct {
+	app *App
+}
+
+func (m *baseModule) Name() string {
+	return "base"
+}
+
+func (m *baseModule) DependsOn() []string {
+	return nil
+}
+
+func (m *baseModule) Init(ctx context.Context) error {
+	if err := m.app.InitBaseConf(m.app.GetConfPath("base")); err != nil {
+		return err
+	}
+	location, err := time.LoadLocation(m.app.ConfBase.TimeLocation)
+	if err != nil {
+		return err
+	}
+	m.app.TimeLocation = location
+	m.app.publish()
+	return nil
+}
+
+func (m *baseModule) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+func (m *baseModule) Close() error {
+	m.app.closeLog()
+	return nil
+}
+
+type redisModule struct {
+	app *App
+}
+
+func (m *redisModule) Name() string {
+	return "redis"
+}
+
+func (m *redisModule) DependsOn() []string {
+	return []string{"base"}
+}
+
+func (m *redisModule) Init(ctx context.Context) error {
+	return m.app.InitRedisConf(m.app.GetConfPath("redis_map"))
+}
+
+func (m *redisModule) HealthCheck(ctx context.Context) error {
+	if m.app.ConfRedisMap == nil {
+		return errors.New("redis conf not loaded")
+	}
+	for name := range m.app.ConfRedisMap.List {
+		c, err := m.app.RedisConnFactory(name)
+		if err != nil {
+			return fmt.Errorf("redis %v:%w", name, err)
+		}
+		_, err = redis.String(c.Do("PING"))
+		c.Close()
+		if err != nil {
+			return fmt.Errorf("redis %v:%w", name, err)
+		}
+	}
+	return nil
+}
+
+func (m *redisModule) Close() error {
+	return nil
+}
+
+type mysqlModule struct {
+	app *App
+}
+
+func (m *mysqlModule) Name() string {
+	return "mysql"
+}
+
+func (m *mysqlModule) DependsOn() []string {
+	return []string{"base"}
+}
+
+func (m *mysqlModule) Init(ctx context.Context) error {
+	if err := m.app.InitDBPool(m.app.GetConfPath("mysql_map")); err != nil {
+		m.app.CloseDB()
+		return err
+	}
+	if err := m.app.runAutoMigrate(ctx); err != nil {
+		m.app.CloseDB()
+		return err
+	}
+	return nil
+}
+
+func (m *mysqlModule) HealthCheck(ctx context.Context) error {
+	for name, pool := range m.app.DBMapPool {
+		if m.app.dbBreakerState(name) == DBBreakerOpen {
+			return fmt.Errorf("mysql %v:%w", name, ErrDBBreakerOpen)
+		}
+		if err := pool.PingContext(ctx); err != nil {
+			return fmt.Errorf("mysql %v:%w", name, err)
+		}
+	}
+	for name, set := range m.app.dbReplicas {
+		for i, pool := range set.pools {
+			if err := pool.PingContext(ctx); err != nil {
+				return fmt.Errorf("mysql %v replica %d:%w", name, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *mysqlModule) Close() error {
+	return m.app.CloseDB()
+}
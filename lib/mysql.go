@@ -5,16 +5,20 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"gorm.io/gorm/utils"
+	"strings"
 	"time"
 )
 
 func InitDBPool(path string) error {
+	return defaultApp.InitDBPool(path)
+}
+
+func (a *App) InitDBPool(path string) (err error) {
 	dbConfMap := &MysqlConfMap{}
-	err := ParseConfig(path, dbConfMap)
+	err = a.ParseConfig(path, dbConfMap)
 	if err != nil {
 		return err
 	}
@@ -22,46 +26,125 @@ func InitDBPool(path string) error {
 		fmt.Printf("[INFO]%s%s\n", time.Now().Format(TimeFormat), "empty mysql config")
 		return errors.New("初始化mysql失败~！")
 	}
-	DBMapPool = map[string]*sql.DB{}
-	GORMMapPool = map[string]*gorm.DB{}
+	a.DBMapPool = map[string]*sql.DB{}
+	a.GORMMapPool = map[string]*gorm.DB{}
+	a.dbConfs = dbConfMap.List
+	a.dbReplicas = map[string]*dbReplicaSet{}
+	a.dbGuards = map[string]*dbGuard{}
+	a.dbHealth = newDBHealthChecker(a.Log)
+	a.slowQueries = newSlowQueryAggregator(a.Log)
+	// 初始化失败时关闭已打开的连接池(含从库)和后台任务
+	defer func() {
+		if err != nil {
+			a.CloseDB()
+		}
+	}()
+	if a.dbAudit, err = a.newDBAuditor(dbConfMap.Audit); err != nil {
+		return err
+	}
 	for confName, conf := range dbConfMap.List {
-		dbPool, err := sql.Open("mysql", conf.DataSourceName)
+		gormLogger, err := a.poolLogger(confName)
+		if err != nil {
+			return fmt.Errorf("mysql %v:%w", confName, err)
+		}
+		driver, err := GetDBDriver(conf.DriverName)
+		if err != nil {
+			return fmt.Errorf("mysql %v:%w", confName, err)
+		}
+		dbPool, err := openDBPool(driver, conf, conf.DataSourceName)
 		if err != nil {
 			return err
 		}
-		dbPool.SetMaxOpenConns(conf.MaxOpenConn)
-		dbPool.SetMaxIdleConns(conf.MaxIdleConn)
-		dbPool.SetConnMaxLifetime(time.Duration(conf.MaxConnLifeTime) * time.Second)
-		err = dbPool.Ping()
-		dbGorm, err := gorm.Open(mysql.New(mysql.Config{Conn: dbPool}), &gorm.Config{
-			Logger: &DefaultMysqlGormLogger,
-		})
+		a.DBMapPool[confName] = dbPool
+		pingErr := a.dbHealth.add(confName, dbPool)
+		dbGorm, guard, err := a.openGorm(confName, gormLogger, driver.dialector(dbPool, pingErr), conf)
 		if err != nil {
 			return err
 		}
-		DBMapPool[confName] = dbPool
-		GORMMapPool[confName] = dbGorm
+		a.dbGuards[confName] = guard
+		a.GORMMapPool[confName] = dbGorm
+		if err := a.openReplicas(confName, driver, conf, dbGorm); err != nil {
+			return err
+		}
 	}
 
-	if pool, err := GetDBPool("default"); err == nil {
-		DBDefaultPool = pool
+	if err := a.dbAudit.openTable(a.GORMMapPool); err != nil {
+		return err
+	}
+	a.dbShards = map[string]*shardRouter{}
+	for name, conf := range dbConfMap.Shards {
+		router, err := newShardRouter(name, conf, a.GORMMapPool)
+		if err != nil {
+			return err
+		}
+		a.dbShards[name] = router
 	}
 
-	if pool, err := GetGormPool("default"); err == nil {
-		GORMDefaultPool = pool
+	if a.dbTenants, err = newTenantRouter(a, dbConfMap.Tenants); err != nil {
+		return err
 	}
+	a.dbTenants.start()
+	a.dbHealth.start()
+	a.slowQueries.startReport()
+	statsPools := map[string]*sql.DB{}
+	for name, pool := range a.DBMapPool {
+		statsPools[name] = pool
+	}
+	for name, set := range a.dbReplicas {
+		for i, pool := range set.pools {
+			statsPools[fmt.Sprintf("%v.replica%d", name, i)] = pool
+		}
+	}
+	dbStats.set(a, statsPools)
+
+	if pool, err := a.GetDBPool("default"); err == nil {
+		a.DBDefaultPool = pool
+	}
+
+	if pool, err := a.GetGormPool("default"); err == nil {
+		a.GORMDefaultPool = pool
+	}
+	a.publish()
 	return nil
 }
 
+// 创建gorm实例并接入熔断、连接等待和审计
+func (a *App) openGorm(name string, gormLogger MysqlGormLogger, dialector gorm.Dialector, conf *MysqlConf) (*gorm.DB, *dbGuard, error) {
+	gormLogger.dialect = dialector.Name()
+	dbGorm, err := gorm.Open(dialector, &gorm.Config{
+		Logger:               &gormLogger,
+		DisableAutomaticPing: true,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	guard := newDBGuard(name, conf, gormLogger.SlowThreshold, a.Log)
+	if err := guard.register(dbGorm); err != nil {
+		return nil, nil, err
+	}
+	if err := dbGorm.Use(&dbAuditPlugin{app: a, pool: name}); err != nil {
+		return nil, nil, err
+	}
+	return dbGorm, guard, nil
+}
+
 func GetDBPool(name string) (*sql.DB, error) {
-	if pool, ok := DBMapPool[name]; ok {
+	return defaultApp.GetDBPool(name)
+}
+
+func (a *App) GetDBPool(name string) (*sql.DB, error) {
+	if pool, ok := a.DBMapPool[name]; ok {
 		return pool, nil
 	}
 	return nil, errors.New("get pool error")
 }
 
 func GetGormPool(name string) (*gorm.DB, error) {
-	if pool, ok := GORMMapPool[name]; ok {
+	return defaultApp.GetGormPool(name)
+}
+
+func (a *App) GetGormPool(name string) (*gorm.DB, error) {
+	if pool, ok := a.GORMMapPool[name]; ok {
 		return pool, nil
 	}
 	return nil, errors.New("get gorm pool error")
@@ -69,13 +152,22 @@ func GetGormPool(name string) (*gorm.DB, error) {
 
 // mysql 日志打印类型
 var DefaultMysqlGormLogger = MysqlGormLogger{
-	LogLevel:      logger.Info,
-	SlowThreshold: 200 * time.Millisecond,
+	LogLevel:                  logger.Info,
+	SlowThreshold:             200 * time.Millisecond,
+	IgnoreRecordNotFoundError: true,
 }
 
 type MysqlGormLogger struct {
 	LogLevel      logger.LogLevel
 	SlowThreshold time.Duration
+	// 为true时记录不存在不输出错误日志
+	IgnoreRecordNotFoundError bool
+	// 为true时日志中的sql保留?占位符,不输出参数值
+	ParameterizedQueries bool
+	log                  *LoggerFaced
+	pool                 string
+	dialect              string
+	slow                 *slowQueryAggregator
 }
 
 func (m MysqlGormLogger) LogMode(level logger.LogLevel) logger.Interface {
@@ -83,74 +175,163 @@ func (m MysqlGormLogger) LogMode(level logger.LogLevel) logger.Interface {
 	return m
 }
 
+func (m MysqlGormLogger) logFaced() *LoggerFaced {
+	if m.log != nil {
+		return m.log
+	}
+	return Log
+}
+
+func (m MysqlGormLogger) fingerprint(sqlStr string) string {
+	return sqlFingerprint(sqlStr, m.dialect == "sqlite")
+}
+
+func (m MysqlGormLogger) observe(sqlStr string, elapsed time.Duration, err error) {
+	fingerprint := m.fingerprint(sqlStr)
+	observeDBQuery(m.pool, fingerprint, elapsed, err)
+	if m.slow != nil && m.SlowThreshold > 0 && elapsed >= m.SlowThreshold {
+		m.slow.add(m.pool, fingerprint, elapsed)
+	}
+}
+
 func (m MysqlGormLogger) Info(ctx context.Context, s string, i ...interface{}) {
-	traceContext := GetTraceContext(ctx)
-	params := make(map[string]interface{})
-	params["message"] = s
-	params["values"] = fmt.Sprint(i...)
-	Log.TagInfo(traceContext, "_com_mysql_Info", params)
+	if m.LogLevel >= logger.Info {
+		m.logFaced().TagInfo(GetTraceContext(ctx), NLTagMySqlInfo, map[string]interface{}{"message": fmt.Sprintf(s, i...)})
+	}
 }
 
 func (m MysqlGormLogger) Warn(ctx context.Context, s string, i ...interface{}) {
-	traceContext := GetTraceContext(ctx)
-	params := make(map[string]interface{})
-	params["message"] = s
-	params["values"] = i
-	Log.TagInfo(traceContext, "_com_mysql_Warn", params)
+	if m.LogLevel >= logger.Warn {
+		m.logFaced().TagWarn(GetTraceContext(ctx), NLTagMySqlWarn, map[string]interface{}{"message": fmt.Sprintf(s, i...)})
+	}
 }
 
-func (m MysqlGormLogger) Error(ctx context.Context, message string, values ...interface{}) {
-	trace := GetTraceContext(ctx)
-	params := make(map[string]interface{})
-	params["message"] = message
-	params["values"] = fmt.Sprint(values...)
-	Log.TagInfo(trace, "_com_mysql_Error", params)
+func (m MysqlGormLogger) Error(ctx context.Context, s string, i ...interface{}) {
+	if m.LogLevel >= logger.Error {
+		m.logFaced().TagError(GetTraceContext(ctx), NLTagMySqlError, map[string]interface{}{"message": fmt.Sprintf(s, i...)})
+	}
 }
 
+// 实现gorm.ParamsFilter,parameterized_queries开启时日志不带参数值
+func (m MysqlGormLogger) ParamsFilter(ctx context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	if m.ParameterizedQueries {
+		return sql, nil
+	}
+	return sql, params
+}
+
+// 失败输出ERROR(_com_mysql_failure),慢查询输出WARN(_com_mysql_slow),其余在Info级别输出_com_mysql_success
 func (m MysqlGormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
-	traceContext := GetTraceContext(ctx)
 	if m.LogLevel <= logger.Silent {
+		if m.pool != "" {
+			sqlStr, _ := fc()
+			m.observe(sqlStr, time.Since(begin), err)
+		}
 		return
 	}
 	sqlStr, rows := fc()
-	currentTime := begin.Format(TimeFormat)
 	since := time.Since(begin)
+	if m.pool != "" {
+		m.observe(sqlStr, since, err)
+	}
+	traceContext := GetTraceContext(ctx)
 	msg := map[string]interface{}{
 		"FileWithLineNum": utils.FileWithLineNum(),
 		"sql":             sqlStr,
 		"rows":            "-",
 		"proc_time":       float64(since.Milliseconds()),
-		"current_time":    currentTime,
+		"current_time":    begin.Format(TimeFormat),
+	}
+	if m.pool != "" {
+		msg["pool"] = m.pool
+	}
+	// Scan/Row经gorm的traceRecorder记录,不走ParamsFilter,输出指纹保证不带参数值
+	if m.ParameterizedQueries {
+		msg["sql"] = m.fingerprint(sqlStr)
+	}
+	if rows != -1 {
+		msg["rows"] = rows
 	}
 	switch {
-	case err != nil && m.LogLevel >= logger.Error && (!errors.Is(err, logger.ErrRecordNotFound)):
-		msg["err"] = err
-		Log.TagError(traceContext, "_com_mysql_failure", msg)
-	case since > m.SlowThreshold && m.SlowThreshold != 0 && m.LogLevel >= logger.Warn:
-		slowLog := fmt.Sprintf("SLOW SQL>=%v", m.SlowThreshold)
-		msg["slowLog"] = slowLog
-		if rows == -1 {
-			Log.TagInfo(traceContext, "_com_mysql_success", msg)
-		} else {
-			msg["rows"] = rows
-			Log.TagInfo(traceContext, "_com_mysql_success", msg)
-		}
+	case err != nil && m.LogLevel >= logger.Error && (!errors.Is(err, logger.ErrRecordNotFound) || !m.IgnoreRecordNotFoundError):
+		msg["err"] = err.Error()
+		m.logFaced().TagError(traceContext, NLTagMySqlFailed, msg)
+	case since >= m.SlowThreshold && m.SlowThreshold != 0 && m.LogLevel >= logger.Warn:
+		msg["slowLog"] = fmt.Sprintf("SLOW SQL>=%v", m.SlowThreshold)
+		msg["fingerprint"] = m.fingerprint(sqlStr)
+		m.logFaced().TagWarn(traceContext, NLTagMySqlSlow, msg)
 	case m.LogLevel == logger.Info:
-		if rows == -1 {
-			Log.TagInfo(traceContext, "_com_mysql_success", msg)
-		} else {
-			msg["rows"] = rows
-			Log.TagInfo(traceContext, "_com_mysql_success", msg)
+		m.logFaced().TagInfo(traceContext, NLTagMySqlSuccess, msg)
+	}
+}
+
+var gormLogLevels = map[string]logger.LogLevel{
+	"silent": logger.Silent,
+	"error":  logger.Error,
+	"warn":   logger.Warn,
+	"info":   logger.Info,
+}
+
+// 按连接池配置生成gorm日志: log_level、slow_threshold_ms、ignore_record_not_found、parameterized_queries
+func (a *App) poolLogger(poolName string) (MysqlGormLogger, error) {
+	l := DefaultMysqlGormLogger
+	l.log = a.Log
+	l.pool = poolName
+	l.SlowThreshold = a.slowThreshold(poolName)
+	l.slow = a.slowQueries
+	conf, ok := a.dbConfs[poolName]
+	if !ok {
+		return l, nil
+	}
+	if conf.LogLevel != "" {
+		level, ok := gormLogLevels[strings.ToLower(conf.LogLevel)]
+		if !ok {
+			return l, fmt.Errorf("unknown log_level %v", conf.LogLevel)
 		}
+		l.LogLevel = level
+	}
+	if conf.IgnoreRecordNotFound != nil {
+		l.IgnoreRecordNotFoundError = *conf.IgnoreRecordNotFound
 	}
+	l.ParameterizedQueries = l.ParameterizedQueries || conf.ParameterizedQueries
+	return l, nil
 }
 
 func CloseDB() error {
-	for _, db := range DBMapPool {
+	return defaultApp.CloseDB()
+}
+
+func (a *App) CloseDB() error {
+	dbStats.set(a, nil)
+	if a.dbHealth != nil {
+		a.dbHealth.stop()
+		a.dbHealth = nil
+	}
+	if a.slowQueries != nil {
+		a.slowQueries.stop()
+		a.slowQueries = nil
+	}
+	a.dbTenants.stop()
+	a.dbTenants = nil
+	a.dbAudit.close()
+	a.dbAudit = nil
+	for _, db := range a.DBMapPool {
 		db.Close()
 	}
-	DBMapPool = make(map[string]*sql.DB)
-	GORMMapPool = make(map[string]*gorm.DB)
+	for _, set := range a.dbReplicas {
+		for _, db := range set.pools {
+			db.Close()
+		}
+	}
+	a.dbReplicas = make(map[string]*dbReplicaSet)
+	a.dbShards = make(map[string]*shardRouter)
+	a.dbGuards = make(map[string]*dbGuard)
+	a.dbConfs = nil
+	a.DBMapPool = make(map[string]*sql.DB)
+	a.GORMMapPool = make(map[string]*gorm.DB)
+	a.DBDefaultPool = nil
+	a.GORMDefaultPool = nil
+	a.publish()
 	return nil
 }
 
@@ -158,14 +339,16 @@ func DBPoolLogQuery(trace *TraceContext, sqlDB *sql.DB, query string, args ...in
 	start := time.Now()
 	rows, err := sqlDB.Query(query, args...)
 	end := time.Now()
+	ObserveDBQuery(dbStats.poolName(sqlDB), query, end.Sub(start), err)
 	if err != nil {
-		Log.TagInfo(trace, "_com_mysql_success", map[string]interface{}{
+		Log.TagError(trace, NLTagMySqlFailed, map[string]interface{}{
 			"sql":       query,
 			"bind":      args,
+			"err":       err.Error(),
 			"proc_time": fmt.Sprintf("%f", end.Sub(start).Seconds()),
 		})
 	} else {
-		Log.TagInfo(trace, "_com_mysql_success", map[string]interface{}{
+		Log.TagInfo(trace, NLTagMySqlSuccess, map[string]interface{}{
 			"sql":       query,
 			"bind":      args,
 			"proc_time": fmt.Sprintf("%f", end.Sub(start).Seconds()),
@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"database/sql"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+	"sync"
+)
+
+// 主库对应的从库连接池和负载策略
+type dbReplicaSet struct {
+	pools  []*sql.DB
+	policy dbresolver.Policy
+}
+
+func (r *dbReplicaSet) resolve() *sql.DB {
+	if len(r.pools) == 1 {
+		return r.pools[0]
+	}
+	connPools := make([]gorm.ConnPool, len(r.pools))
+	for i, pool := range r.pools {
+		connPools[i] = pool
+	}
+	return r.policy.Resolve(connPools).(*sql.DB)
+}
+
+// 按配置生成从库负载策略: round_robin(默认)、weighted、random
+func NewReplicaPolicy(conf *MysqlConf) (dbresolver.Policy, error) {
+	switch conf.ReplicaPolicy {
+	case "", "round_robin":
+		return dbresolver.StrictRoundRobinPolicy(), nil
+	case "random":
+		return dbresolver.RandomPolicy{}, nil
+	case "weighted":
+		weights := make([]int, len(conf.Replicas))
+		for i, replica := range conf.Replicas {
+			weights[i] = replica.Weight
+		}
+		return &weightedPolicy{weights: weights}, nil
+	}
+	return nil, fmt.Errorf("unknown replica_policy %v", conf.ReplicaPolicy)
+}
+
+// 平滑加权轮询,weights与从库顺序一一对应,未配置或<=0按1处理
+type weightedPolicy struct {
+	lock    sync.Mutex
+	weights []int
+	current []int
+}
+
+func (p *weightedPolicy) Resolve(connPools []gorm.ConnPool) gorm.ConnPool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.current) != len(connPools) {
+		p.current = make([]int, len(connPools))
+	}
+	best, total := 0, 0
+	for i := range connPools {
+		weight := 1
+		if i < len(p.weights) && p.weights[i] > 0 {
+			weight = p.weights[i]
+		}
+		p.current[i] += weight
+		total += weight
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= total
+	return connPools[best]
+}
+
+// 打开从库并注册dbresolver: 查询走从库,写入和事务走主库
+func (a *App) openReplicas(confName string, driver DBDriver, conf *MysqlConf, dbGorm *gorm.DB) error {
+	if len(conf.Replicas) == 0 {
+		return nil
+	}
+	policy, err := NewReplicaPolicy(conf)
+	if err != nil {
+		return fmt.Errorf("mysql %v:%w", confName, err)
+	}
+	set := &dbReplicaSet{policy: policy}
+	a.dbReplicas[confName] = set
+	dialectors := make([]gorm.Dialector, 0, len(conf.Replicas))
+	for i, replica := range conf.Replicas {
+		pool, err := openDBPool(driver, conf, replica.DataSourceName)
+		if err != nil {
+			return err
+		}
+		set.pools = append(set.pools, pool)
+		pingErr := a.dbHealth.add(fmt.Sprintf("%v.replica%d", confName, i), pool)
+		dialectors = append(dialectors, driver.dialector(pool, pingErr))
+	}
+	return dbGorm.Use(dbresolver.Register(dbresolver.Config{
+		Replicas: dialectors,
+		Policy:   policy,
+	}))
+}
+
+func GetDBReadPool(name string) (*sql.DB, error) {
+	return defaultApp.GetDBReadPool(name)
+}
+
+// 原生sql读连接池,配置了从库时按策略选择从库,否则返回主库
+func (a *App) GetDBReadPool(name string) (*sql.DB, error) {
+	if set, ok := a.dbReplicas[name]; ok && len(set.pools) > 0 {
+		return set.resolve(), nil
+	}
+	return a.GetDBPool(name)
+}
+
+// 强制本次查询走主库,用于写后立即读等场景
+func UsePrimary(db *gorm.DB) *gorm.DB {
+	return db.Clauses(dbresolver.Write)
+}
@@ -9,8 +9,12 @@ import (
 )
 
 func RedisConnFactory(name string) (redis.Conn, error) {
-	if ConfRedisMap != nil && ConfRedisMap.List != nil {
-		for confName, conf := range ConfRedisMap.List {
+	return defaultApp.RedisConnFactory(name)
+}
+
+func (a *App) RedisConnFactory(name string) (redis.Conn, error) {
+	if a.ConfRedisMap != nil && a.ConfRedisMap.List != nil {
+		for confName, conf := range a.ConfRedisMap.List {
 			if name == confName {
 				randHost := conf.ProxyList[rand.Intn(len(conf.ProxyList))]
 				if conf.ConnTimeout == 0 {
@@ -71,9 +75,13 @@ func RedisLogDo(trace *TraceContext, c redis.Conn, commandName string, args ...i
 	return reply, err
 }
 func RedisConfDo(trace *TraceContext, name string, commandName string, args ...interface{}) (interface{}, error) {
-	c, err := RedisConnFactory(name)
+	return defaultApp.RedisConfDo(trace, name, commandName, args...)
+}
+
+func (a *App) RedisConfDo(trace *TraceContext, name string, commandName string, args ...interface{}) (interface{}, error) {
+	c, err := a.RedisConnFactory(name)
 	if err != nil {
-		Log.TagError(trace, "_com_redis_failure", map[string]interface{}{
+		a.Log.TagError(trace, "_com_redis_failure", map[string]interface{}{
 			"method": commandName,
 			"err":    errors.New("RedisConnFactory_error:" + name),
 			"bind":   args,
@@ -86,7 +94,7 @@ func RedisConfDo(trace *TraceContext, name string, commandName string, args ...i
 	reply, err := c.Do(commandName, args...)
 	endExecTime := time.Now()
 	if err != nil {
-		Log.TagError(trace, "_com_redis_failure", map[string]interface{}{
+		a.Log.TagError(trace, "_com_redis_failure", map[string]interface{}{
 			"method":    commandName,
 			"err":       err,
 			"bind":      args,
@@ -94,7 +102,7 @@ func RedisConfDo(trace *TraceContext, name string, commandName string, args ...i
 		})
 	} else {
 		replyStr, _ := redis.String(reply, nil)
-		Log.TagInfo(trace, "_com_redis_success", map[string]interface{}{
+		a.Log.TagInfo(trace, "_com_redis_success", map[string]interface{}{
 			"method":    commandName,
 			"bind":      args,
 			"reply":     replyStr,
@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var DefaultShutdownTimeout = 10 * time.Second
+
+type shutdownHook struct {
+	name    string
+	timeout time.Duration
+	fn      func(ctx context.Context) error
+}
+
+// 关闭过程中超时或失败的步骤
+type ShutdownError struct {
+	TimedOut []string
+	Failed   map[string]error
+	lock     sync.Mutex
+}
+
+func (e *ShutdownError) Error() string {
+	var parts []string
+	if len(e.TimedOut) > 0 {
+		parts = append(parts, "timeout: "+strings.Join(e.TimedOut, ","))
+	}
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%v: %v", name, e.Failed[name]))
+	}
+	return "shutdown " + strings.Join(parts, "; ")
+}
+
+// 在独立的deadline内执行一步关闭操作,超时后不再等待
+func (e *ShutdownError) run(ctx context.Context, name string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- fn(stepCtx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-stepCtx.Done():
+		err = fmt.Errorf("%v timeout after %v", name, timeout)
+		log.Printf("[WARN] shutdown %s timeout after %v\n", name, timeout)
+		e.lock.Lock()
+		e.TimedOut = append(e.TimedOut, name)
+		e.lock.Unlock()
+		return err
+	}
+	if err != nil {
+		log.Printf("[WARN] shutdown %s fail:%v\n", name, err)
+		e.lock.Lock()
+		if e.Failed == nil {
+			e.Failed = map[string]error{}
+		}
+		e.Failed[name] = err
+		e.lock.Unlock()
+	}
+	return err
+}
+
+func (e *ShutdownError) err() error {
+	if len(e.TimedOut) == 0 && len(e.Failed) == 0 {
+		return nil
+	}
+	return e
+}
+
+// 注册关闭钩子,timeout<=0时使用DefaultShutdownTimeout;
+// 关闭时全部钩子按注册的逆序先执行,之后才按依赖逆序关闭模块,与钩子在InitModule前后注册无关,钩子中仍可使用各模块
+func OnShutdown(name string, timeout time.Duration, fn func(ctx context.Context) error) {
+	defaultApp.OnShutdown(name, timeout, fn)
+}
+
+func (a *App) OnShutdown(name string, timeout time.Duration, fn func(ctx context.Context) error) {
+	a.moduleLock.Lock()
+	defer a.moduleLock.Unlock()
+	a.shutdownHooks = append(a.shutdownHooks, shutdownHook{name: name, timeout: timeout, fn: fn})
+}
+
+// 依次执行关闭钩子、逆序关闭模块,最后关闭日志
+func (a *App) Shutdown(ctx context.Context) error {
+	a.moduleLock.Lock()
+	hooks := a.shutdownHooks
+	a.shutdownHooks = nil
+	a.moduleLock.Unlock()
+	report := &ShutdownError{}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		report.run(ctx, hooks[i].name, hooks[i].timeout, hooks[i].fn)
+	}
+	a.closeModules(ctx, report)
+	return report.err()
+}
+
+// 运行fn直到返回或收到SIGINT/SIGTERM,随后执行关闭流程
+func Run(ctx context.Context, fn func(ctx context.Context) error) error {
+	return defaultApp.Run(ctx, fn)
+}
+
+func (a *App) Run(ctx context.Context, fn func(ctx context.Context) error) error {
+	runCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(runCtx)
+	}()
+
+	var runErr error
+	select {
+	case runErr = <-done:
+	case <-runCtx.Done():
+		log.Printf("[INFO] %s\n", " receive stop signal, start graceful shutdown.")
+		timer := time.NewTimer(DefaultShutdownTimeout)
+		select {
+		case runErr = <-done:
+		case <-timer.C:
+			runErr = fmt.Errorf("run timeout after %v", DefaultShutdownTimeout)
+		}
+		timer.Stop()
+	}
+	if errors.Is(runErr, context.Canceled) {
+		runErr = nil
+	}
+	stop()
+
+	log.Println("------------------------------------------------------------------------")
+	log.Printf("[INFO] %s\n", " start destroy resources.")
+	shutdownErr := a.Shutdown(context.Background())
+	log.Printf("[INFO] %s\n", " finish destroy resources.")
+	return errors.Join(runErr, shutdownErr)
+}
@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	fingerprintStringRegexp = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'`)
+	fingerprintDoubleRegexp = regexp.MustCompile(`"(?:[^"\\]|\\.|"")*"`)
+	fingerprintNumberRegexp = regexp.MustCompile(`\b-?\d+(?:\.\d+)?(?:e[+-]?\d+)?\b|\b0x[0-9a-f]+\b`)
+	fingerprintListRegexp   = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)+\s*\)`)
+	fingerprintValuesRegexp = regexp.MustCompile(`(values\s*\(\?\+?\))(?:\s*,\s*\(\?\+?\))+`)
+	fingerprintSpaceRegexp  = regexp.MustCompile(`\s+`)
+)
+
+// 归一化sql: 常量替换为?,IN列表和多行VALUES折叠,用于按语句模板聚合指标
+// select * from user where id in (1,2,3) and name='a' => select * from user where id in (?+) and name=?
+func SQLFingerprint(sql string) string {
+	return sqlFingerprint(sql, false)
+}
+
+// sqlite的gorm日志用双引号包裹字符串,postgres的双引号是标识符,仅sqlite按字符串处理
+func sqlFingerprint(sql string, doubleQuoted bool) string {
+	fp := strings.ToLower(strings.TrimSpace(sql))
+	fp = strings.TrimSuffix(fp, ";")
+	fp = fingerprintStringRegexp.ReplaceAllString(fp, "?")
+	if doubleQuoted {
+		fp = fingerprintDoubleRegexp.ReplaceAllString(fp, "?")
+	}
+	fp = fingerprintNumberRegexp.ReplaceAllString(fp, "?")
+	fp = fingerprintSpaceRegexp.ReplaceAllString(fp, " ")
+	fp = fingerprintListRegexp.ReplaceAllString(fp, "(?+)")
+	fp = fingerprintValuesRegexp.ReplaceAllString(fp, "$1")
+	return fp
+}
@@ -58,3 +58,29 @@ func SetTraceContext(ctx context.Context, trace *TraceContext) context.Context {
 	}
 	return context.WithValue(ctx, "trace", trace)
 }
+
+func SetGinTenant(c *gin.Context, tenant string) error {
+	if c == nil {
+		return errors.New("context is nil")
+	}
+	c.Set("tenant", tenant)
+	return nil
+}
+
+type tenantCtxKey struct{}
+
+// 租户id与trace一样随ctx传递,TenantDB据此选择连接池
+func SetTenantContext(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantCtxKey{}, tenant)
+}
+
+func GetTenantId(ctx context.Context) string {
+	if ginCTX, ok := ctx.(*gin.Context); ok {
+		return ginCTX.GetString("tenant")
+	}
+	if ctx == nil {
+		return ""
+	}
+	tenant, _ := ctx.Value(tenantCtxKey{}).(string)
+	return tenant
+}
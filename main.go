@@ -1,12 +1,15 @@
 package main
 
 import (
+	"flag"
 	"github.com/m17621679833/nice_base/lib"
 	"log"
 	"time"
 )
 
 func main() {
+	lib.Configure(lib.WithFlagSet(flag.CommandLine))
+	flag.Parse()
 	if err := lib.InitModule("./conf/dev/", []string{"base", "mysql", "redis"}); err != nil {
 		log.Fatal(err)
 	}
@@ -205,6 +205,11 @@ func NewLogger() *Logger {
 		takeUp = true
 		return defaultLogger
 	}
+	return New()
+}
+
+// 创建独立的日志实例,不会复用默认日志
+func New() *Logger {
 	logger := new(Logger)
 	logger.writers = []Writer{}
 	logger.tunnel = make(chan *Record, TUNNEL_DEFAULT_SIZE)
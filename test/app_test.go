@@ -0,0 +1,123 @@
+package test
+
+import (
+	"flag"
+	"github.com/m17621679833/nice_base/lib"
+	_ "github.com/m17621679833/nice_base/lib/driver/postgres"
+	_ "github.com/m17621679833/nice_base/lib/driver/sqlite"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestEnv(t *testing.T, env string, files map[string]string) string {
+	dir := filepath.Join(t.TempDir(), env)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir + "/"
+}
+
+const testBaseToml = "[base]\ntime_location = \"UTC\"\n[log]\nlog_level = \"info\"\n"
+
+// 用给定的mysql_map.toml创建配置目录并初始化mysql模块,测试结束时Destroy
+func newSqliteApp(t *testing.T, env, mysqlToml string) *lib.App {
+	return newMysqlApp(t, newTestEnv(t, env, map[string]string{
+		"base.toml":      testBaseToml,
+		"mysql_map.toml": mysqlToml,
+	}))
+}
+
+// 在已有配置目录上初始化mysql模块,用于同一配置启动多个App
+func newMysqlApp(t *testing.T, dir string) *lib.App {
+	app := lib.New(lib.WithConfigPath(dir), lib.WithModulePolicy("mysql", lib.PolicyRequired))
+	if err := app.InitModule([]string{"mysql"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.Destroy)
+	return app
+}
+
+func TestApp(t *testing.T) {
+	dir1 := newTestEnv(t, "app1", map[string]string{
+		"base.toml": "[base]\ntime_location = \"Asia/Shanghai\"\n[log]\nlog_level = \"info\"\n",
+		"test.toml": "server_addr = \":8001\"\n",
+	})
+	dir2 := newTestEnv(t, "app2", map[string]string{
+		"base.toml": "[base]\ntime_location = \"UTC\"\n[log]\nlog_level = \"info\"\n",
+		"test.toml": "server_addr = \":8002\"\n",
+	})
+
+	app1 := lib.New(lib.WithConfigPath(dir1))
+	app2 := lib.New(lib.WithConfigPath(dir2))
+	if err := app1.InitModule([]string{"base"}); err != nil {
+		t.Fatal(err)
+	}
+	defer app1.Destroy()
+	if err := app2.InitModule([]string{"base"}); err != nil {
+		t.Fatal(err)
+	}
+	defer app2.Destroy()
+
+	if app1.GetConfEnv() != "app1" || app2.GetConfEnv() != "app2" {
+		t.Fatal("unexpected env:", app1.GetConfEnv(), app2.GetConfEnv())
+	}
+	if app1.GetStringConf("test.server_addr") != ":8001" || app2.GetStringConf("test.server_addr") != ":8002" {
+		t.Fatal("config leaked between apps")
+	}
+	if app1.TimeLocation.String() != "Asia/Shanghai" || app2.TimeLocation.String() != "UTC" {
+		t.Fatal("unexpected time location:", app1.TimeLocation, app2.TimeLocation)
+	}
+	addr, err := lib.AppConf[string](app2, "test.server_addr")
+	if err != nil || addr != ":8002" {
+		t.Fatal("AppConf:", addr, err)
+	}
+	if lib.ConfEnv == "app1" || lib.ConfEnv == "app2" {
+		t.Fatal("non-default app leaked into globals:", lib.ConfEnv)
+	}
+	app1.Log.TagInfo(lib.NewTrace(), lib.CreateBizNLTag("app1"), map[string]interface{}{"msg": "hello"})
+}
+
+func TestAppConfigSource(t *testing.T) {
+	base := "[base]\ntime_location = \"UTC\"\n[log]\nlog_level = \"info\"\n"
+	codeDir := newTestEnv(t, "code", map[string]string{"base.toml": base})
+	envDir := newTestEnv(t, "fromenv", map[string]string{"base.toml": base})
+	flagDir := newTestEnv(t, "fromflag", map[string]string{"base.toml": base})
+
+	if err := lib.New().InitModule([]string{"base"}); err == nil {
+		t.Fatal("expect error without config source")
+	}
+
+	t.Setenv(lib.ConfigEnv, strings.TrimSuffix(envDir, "/"))
+	app := lib.New(lib.WithConfigPath(codeDir))
+	if err := app.InitModule([]string{"base"}); err != nil {
+		t.Fatal(err)
+	}
+	app.Destroy()
+	if app.GetConfEnv() != "fromenv" {
+		t.Fatal("env should override code path:", app.GetConfEnv())
+	}
+
+	fs := flag.NewFlagSet("host", flag.ContinueOnError)
+	verbose := fs.Bool("v", false, "host flag")
+	app = lib.New(lib.WithConfigPath(codeDir), lib.WithFlagSet(fs))
+	if err := fs.Parse([]string{"-v", "-config", flagDir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.InitModule([]string{"base"}); err != nil {
+		t.Fatal(err)
+	}
+	app.Destroy()
+	if app.GetConfEnv() != "fromflag" || !*verbose {
+		t.Fatal("flag should override env:", app.GetConfEnv())
+	}
+	if flag.CommandLine.Lookup("config") != nil {
+		t.Fatal("global FlagSet should stay untouched")
+	}
+}
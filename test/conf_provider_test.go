@@ -0,0 +1,135 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/m17621679833/nice_base/lib"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type kvStub struct {
+	sync.Mutex
+	index uint64
+	files map[string]string
+}
+
+func (s *kvStub) set(name, value string) {
+	s.Lock()
+	defer s.Unlock()
+	s.files[name] = value
+	s.index++
+}
+
+func (s *kvStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); index > 0 {
+		for i := 0; i < 100; i++ {
+			s.Lock()
+			changed := s.index != index
+			s.Unlock()
+			if changed {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	pairs := []map[string]interface{}{}
+	for name, value := range s.files {
+		pairs = append(pairs, map[string]interface{}{"Key": "nice_base/dev/" + name, "Value": []byte(value)})
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func TestConfProvider(t *testing.T) {
+	stub := &kvStub{index: 1, files: map[string]string{
+		"base.toml": "[base]\ntime_location = \"Asia/Shanghai\"\n[log]\nlog_level = \"info\"\n",
+		"test.toml": "server_addr = \":8031\"\n",
+	}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "snapshot.json")
+	provider := lib.NewSnapshotCacheProvider(lib.NewHTTPKVProvider(server.URL, "nice_base/dev"), cacheFile)
+	if err := lib.InitModuleWithProvider(provider, []string{"base"}); err != nil {
+		t.Fatal(err)
+	}
+	defer lib.Destroy()
+	if lib.GetConfEnv() != "dev" || lib.GetStringConf("test.server_addr") != ":8031" {
+		t.Fatal("load remote config fail:", lib.GetConfEnv(), lib.GetStringConf("test.server_addr"))
+	}
+	if lib.TimeLocation == nil || lib.TimeLocation.String() != "Asia/Shanghai" {
+		t.Fatal("base conf not loaded:", lib.TimeLocation)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	changedCh := make(chan []string, 1)
+	go lib.WatchConf(ctx, func(changed []string) {
+		changedCh <- changed
+	})
+	time.Sleep(100 * time.Millisecond)
+	stub.set("test.toml", "server_addr = \":9031\"\n")
+	select {
+	case changed := <-changedCh:
+		if len(changed) != 1 || changed[0] != "test.toml" {
+			t.Fatal("unexpected changed files:", changed)
+		}
+	case <-ctx.Done():
+		t.Fatal("watch timeout")
+	}
+	if addr := lib.GetStringConf("test.server_addr"); addr != ":9031" {
+		t.Fatal("config not reloaded:", addr)
+	}
+
+	server.Close()
+	snapshot, err := provider.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(snapshot["test.toml"]) != "server_addr = \":9031\"\n" {
+		t.Fatal("unexpected snapshot:", string(snapshot["test.toml"]))
+	}
+}
+
+func TestConfFileProvider(t *testing.T) {
+	dir := newTestEnv(t, "file_provider", map[string]string{
+		"base.toml": "[base]\ntime_location = \"UTC\"\n",
+		"extra.ini": "server_addr = \":8032\"\n",
+	})
+	snapshot, err := lib.NewFileProvider(dir).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 和InitViperConf一致,非.toml文件也会加载
+	if len(snapshot) != 2 || string(snapshot["extra.ini"]) != "server_addr = \":8032\"\n" {
+		t.Fatal("unexpected snapshot:", snapshot)
+	}
+}
+
+func TestInitViperConfLoadError(t *testing.T) {
+	dir := t.TempDir()
+	missing := lib.New()
+	missing.ParseConfigPath(filepath.Join(dir, "missing") + "/")
+	if err := missing.InitViperConf(); err != nil {
+		t.Fatal("missing config dir should be skipped:", err)
+	}
+	// 配置路径不是目录,读取失败需要返回
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	broken := lib.New()
+	broken.ParseConfigPath(file + "/")
+	if err := broken.InitViperConf(); err == nil {
+		t.Fatal("load error should be returned")
+	}
+}
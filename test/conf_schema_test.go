@@ -0,0 +1,60 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/m17621679833/nice_base/lib"
+	"strings"
+	"testing"
+)
+
+func TestConfSchema(t *testing.T) {
+	schema := lib.GenerateJSONSchema(HttpConf{})
+	data, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"max_header_bytes":{"type":"integer"}`) ||
+		!strings.Contains(string(data), `"additionalProperties":false`) {
+		t.Fatal("unexpected schema:", string(data))
+	}
+
+	redisSchema, err := lib.ConfJSONSchema("redis_map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := redisSchema.Properties["list"].AdditionalProperties.(*lib.JSONSchema)
+	if conf.Properties["conn_timeout"].Default != int64(50) || len(conf.Required) != 1 || conf.Required[0] != "proxy_list" {
+		t.Fatal("unexpected redis schema:", conf.Properties["conn_timeout"], conf.Required)
+	}
+
+	dir := newTestEnv(t, "ci", map[string]string{
+		"base.toml":      "[base]\ndebug_mode = \"debug\"\n[log]\nlog_level = \"verbose\"\n",
+		"mysql_map.toml": "[list.default]\ndata_source_name = \"root:root@tcp(127.0.0.1:3306)/gateway\"\nmax_open_conn = -1\nmax_conn_life_tme = 100\n",
+		"redis_map.toml": "[list.default]\nproxy_list = []\nconn_timeout = \"50\"\n",
+		"test.toml":      "server_addr = \":8031\"\n",
+	})
+	snapshot, err := lib.NewFileProvider(dir).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, err := lib.ValidateConfSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"base.log.log_level: verbose not in",
+		"mysql_map.list.default.max_conn_life_tme: unknown key",
+		"mysql_map.list.default.max_open_conn: -1 less than 0",
+		"redis_map.list.default.conn_timeout: expect integer",
+		"redis_map.list.default.proxy_list: need at least 1 items",
+	}
+	if len(errs) != len(expect) {
+		t.Fatal("unexpected errors:", errs)
+	}
+	for i, prefix := range expect {
+		if !strings.HasPrefix(errs[i], prefix) {
+			t.Fatalf("error %d: expect %q, got %q", i, prefix, errs[i])
+		}
+	}
+}
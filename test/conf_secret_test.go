@@ -0,0 +1,78 @@
+package test
+
+import (
+	"github.com/m17621679833/nice_base/lib"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfSecret(t *testing.T) {
+	keyStr, err := lib.NewConfKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(lib.ConfKeyEnv, keyStr)
+	key, err := lib.LoadConfKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password, err := lib.EncryptConfValue(key, "Huawei@2023")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPassword, err := lib.EncryptConfValue(key, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lib.IsEncryptedConfValue(password) {
+		t.Fatal("expect encrypted value:", password)
+	}
+
+	dir := t.TempDir()
+	redisPath := filepath.Join(dir, "redis_map.toml")
+	redisToml := "[list.default]\nproxy_list = [\"127.0.0.1:6379\"]\npassword = \"" + password + "\"\n"
+	if err := os.WriteFile(redisPath, []byte(redisToml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	redisConf := &lib.RedisConfMap{}
+	if err := lib.ParseConfig(redisPath, redisConf); err != nil {
+		t.Fatal(err)
+	}
+	if redisConf.List["default"].Password != "Huawei@2023" {
+		t.Fatal("decrypt password fail:", redisConf.List["default"].Password)
+	}
+
+	mysqlPath := filepath.Join(dir, "mysql_map.toml")
+	mysqlToml := "[list.default]\ndata_source_name = \"root:" + dbPassword + "@tcp(127.0.0.1:3306)/gateway\"\n"
+	if err := os.WriteFile(mysqlPath, []byte(mysqlToml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mysqlConf := &lib.MysqlConfMap{}
+	if err := lib.ParseConfig(mysqlPath, mysqlConf); err != nil {
+		t.Fatal(err)
+	}
+	if mysqlConf.List["default"].DataSourceName != "root:s3cret@tcp(127.0.0.1:3306)/gateway" {
+		t.Fatal("decrypt dsn fail:", mysqlConf.List["default"].DataSourceName)
+	}
+
+	badPath := filepath.Join(dir, "bad.toml")
+	badToml := "[list.default]\nproxy_list = [\"127.0.0.1:6379\"]\ndb = \"" + password + "\"\n"
+	if err := os.WriteFile(badPath, []byte(badToml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = lib.ParseConfig(badPath, &lib.RedisConfMap{})
+	if err == nil {
+		t.Fatal("expect unmarshal error")
+	}
+	if strings.Contains(err.Error(), "Huawei@2023") || strings.Contains(err.Error(), "proxy_list") {
+		t.Fatal("error leaks config content:", err)
+	}
+
+	t.Setenv(lib.ConfKeyEnv, "")
+	if err := lib.ParseConfig(redisPath, &lib.RedisConfMap{}); err == nil {
+		t.Fatal("expect missing key error")
+	}
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"errors"
+	"github.com/m17621679833/nice_base/lib"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfTyped(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dev")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	appToml := `server_addr = ":8031"
+allow_host = ["127.0.0.1"]
+read_timeout = 10
+idle_timeout = "1m30s"
+time_location = "Asia/Shanghai"
+[cache]
+    ttl = "5s"
+    hosts = ["a", "b"]
+`
+	if err := os.WriteFile(filepath.Join(dir, "app.toml"), []byte(appToml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.ParseConfigPath(dir + "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.InitViperConf(); err != nil {
+		t.Fatal(err)
+	}
+
+	if addr := lib.MustConf[string]("app.server_addr"); addr != ":8031" {
+		t.Fatal("server_addr:", addr)
+	}
+	if d := lib.MustConf[time.Duration]("app.idle_timeout"); d != 90*time.Second {
+		t.Fatal("idle_timeout:", d)
+	}
+	if hosts := lib.MustConf[[]string]("app.allow_host"); len(hosts) != 1 || hosts[0] != "127.0.0.1" {
+		t.Fatal("allow_host:", hosts)
+	}
+	if loc := lib.MustConf[*time.Location]("app.time_location"); loc.String() != "Asia/Shanghai" {
+		t.Fatal("time_location:", loc)
+	}
+	type CacheConf struct {
+		TTL   time.Duration `mapstructure:"ttl"`
+		Hosts []string      `mapstructure:"hosts"`
+	}
+	cache, err := lib.Conf[CacheConf]("app.cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.TTL != 5*time.Second || len(cache.Hosts) != 2 {
+		t.Fatal("cache:", cache)
+	}
+	http, err := lib.Conf[HttpConf]("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if http.ServerAddr != ":8031" || http.ReadTimeout != 10 {
+		t.Fatal("http:", http)
+	}
+
+	if _, err := lib.Conf[string]("nofile.server_addr"); !errors.Is(err, lib.ErrConfFileNotFound) {
+		t.Fatal("expect ErrConfFileNotFound:", err)
+	}
+	if _, err := lib.Conf[string]("app.nokey"); !errors.Is(err, lib.ErrConfKeyNotFound) {
+		t.Fatal("expect ErrConfKeyNotFound:", err)
+	}
+	if _, err := lib.Conf[int]("app.server_addr"); !errors.Is(err, lib.ErrConfTypeMismatch) {
+		t.Fatal("expect ErrConfTypeMismatch:", err)
+	}
+	if v := lib.GetIntConf("nofile.read_timeout"); v != 0 {
+		t.Fatal("expect zero value:", v)
+	}
+}
@@ -0,0 +1,180 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type auditAccount struct {
+	Id      int64  `gorm:"column:id;primary_key;autoIncrement"`
+	Name    string `gorm:"column:name"`
+	Balance int    `gorm:"column:balance"`
+}
+
+func (auditAccount) TableName() string {
+	return "audit_account"
+}
+
+func TestDBAuditTable(t *testing.T) {
+	app := newSqliteApp(t, "audit", fmt.Sprintf(`[list.default]
+driver_name = "sqlite"
+data_source_name = %q
+max_open_conn = 1
+[audit]
+output = "table"
+image_tables = ["audit_*"]
+exclude_tables = ["audit_skip"]
+`, filepath.Join(t.TempDir(), "audit.db")))
+	db := app.GORMDefaultPool
+	for _, ddl := range []string{
+		"create table audit_account (id integer primary key autoincrement, name text, balance integer)",
+		"create table audit_skip (id integer primary key)",
+		"create table sql_audit_log (id integer primary key autoincrement, trace_id text, user text, pool text, table_name text, " +
+			"action text, sql_text text, rows_affected integer, before_image text, after_image text, err text, created_at datetime)",
+	} {
+		if err := db.Exec(ddl).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	trace := lib.NewTrace()
+	ctx := lib.WithAuditUser(lib.SetTraceContext(context.Background(), trace), "alice")
+	type userKey string
+	if lib.GetAuditUser(context.WithValue(ctx, userKey("audit_user"), "mallory")) != "alice" {
+		t.Fatal("audit user should only be read from its own ctx key")
+	}
+
+	account := auditAccount{Name: "a", Balance: 100}
+	if err := db.WithContext(ctx).Create(&account).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WithContext(ctx).Model(&account).Update("balance", 50).Error; err != nil {
+		t.Fatal(err)
+	}
+	var found []auditAccount
+	db.WithContext(ctx).Find(&found)
+	db.WithContext(ctx).Exec("insert into audit_skip (id) values (1)")
+	if _, err := app.DBExec(ctx, "default", "update audit_account set name = ? where id = ?", "b", account.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WithContext(ctx).Where("balance = ?", 50).Delete(&auditAccount{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 事务独占唯一的连接,审计表写入不能在事务内同步执行
+	done := make(chan error, 1)
+	go func() {
+		done <- app.WithTx(ctx, "default", func(tx *gorm.DB) error {
+			return tx.Create(&auditAccount{Name: "tx"}).Error
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("audit write inside a transaction should not block")
+	}
+
+	var records []lib.AuditRecord
+	for deadline := time.Now().Add(2 * time.Second); len(records) < 5 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		records = nil
+		if err := db.Table("sql_audit_log").Order("id").Find(&records).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(records) != 5 {
+		t.Fatalf("want 5 audit records, got %+v", records)
+	}
+	for i, action := range []string{"insert", "update", "update", "delete", "insert"} {
+		r := records[i]
+		if r.Action != action || r.Table != "audit_account" || r.User != "alice" || r.TraceId != trace.TraceId || r.RowsAffected != 1 {
+			t.Fatalf("record %d: %+v", i, r)
+		}
+	}
+	if !strings.Contains(records[0].After, `"balance":100`) {
+		t.Fatal("insert after image:", records[0].After)
+	}
+	if !strings.Contains(records[1].Before, `"balance":100`) || !strings.Contains(records[1].After, `"balance":50`) {
+		t.Fatal("update images:", records[1].Before, records[1].After)
+	}
+	if !strings.Contains(records[2].SQL, `name = "b"`) || records[2].Before != "" {
+		t.Fatal("raw exec:", records[2])
+	}
+	if !strings.Contains(records[3].Before, `"name":"b"`) || records[3].After != "" {
+		t.Fatal("delete before image:", records[3])
+	}
+}
+
+type auditCapture struct {
+	records []*lib.AuditRecord
+}
+
+func (c *auditCapture) WriteAudit(ctx context.Context, r *lib.AuditRecord) error {
+	c.records = append(c.records, r)
+	return nil
+}
+
+func TestDBAuditLog(t *testing.T) {
+	tmp := t.TempDir()
+	app := newSqliteApp(t, "audit_log", fmt.Sprintf(`[list.default]
+driver_name = "sqlite"
+data_source_name = %q
+[list.plain]
+driver_name = "sqlite"
+data_source_name = %q
+[audit]
+log_path = %q
+`, filepath.Join(tmp, "audit.db"), filepath.Join(tmp, "plain.db"), filepath.Join(tmp, "audit.log")))
+	ctx := lib.WithAuditUser(context.Background(), "bob")
+	db := app.GORMDefaultPool.WithContext(ctx)
+	db.Exec("create table audit_account (id integer primary key autoincrement, name text, balance integer)")
+	if err := db.Create(&auditAccount{Name: "logged"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	capture := &auditCapture{}
+	app.SetAuditWriter(capture)
+	plain, _ := app.GetGormPool("plain")
+	plain.WithContext(ctx).Exec("create table audit_account (id integer primary key autoincrement, name text, balance integer)")
+	if err := plain.WithContext(ctx).Create(&auditAccount{Name: "captured"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(capture.records) != 1 || capture.records[0].Pool != "plain" || capture.records[0].User != "bob" || capture.records[0].After != "" {
+		t.Fatalf("custom writer: %+v", capture.records)
+	}
+	// 请求处理中并发替换writer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			app.SetAuditWriter(capture)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := plain.WithContext(ctx).Create(&auditAccount{Name: "captured"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if len(capture.records) != 21 {
+		t.Fatal("custom writer records:", len(capture.records))
+	}
+	app.Destroy()
+
+	out, err := os.ReadFile(filepath.Join(tmp, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(out); !strings.Contains(s, "_com_mysql_audit") || !strings.Contains(s, "user=bob") || !strings.Contains(s, "logged") || strings.Contains(s, "captured") {
+		t.Fatal("audit log:", s)
+	}
+}
@@ -0,0 +1,180 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type waitItem struct {
+	Id int `gorm:"primary_key"`
+}
+
+func (waitItem) TableName() string {
+	return "wait_item"
+}
+
+func TestDBBreaker(t *testing.T) {
+	tmp := t.TempDir()
+	app := newSqliteApp(t, "breaker", fmt.Sprintf(`[list.breaker]
+driver_name = "sqlite"
+data_source_name = %q
+max_open_conn = 4
+max_conn_wait_ms = 1000
+[list.breaker.breaker]
+error_rate = 0.5
+min_requests = 4
+open_ms = 100
+[list.wait]
+driver_name = "sqlite"
+data_source_name = %q
+max_open_conn = 1
+max_conn_wait_ms = 50
+`, filepath.Join(tmp, "breaker.db"), filepath.Join(tmp, "wait.db")))
+	ctx := context.Background()
+	db, _ := app.GetGormPool("breaker")
+	var n int
+	if err := db.Raw("select 1").Scan(&n).Error; err != nil || n != 1 {
+		t.Fatal(err, n)
+	}
+	if state := app.DBHealth()["breaker"].Breaker; state != lib.DBBreakerClosed {
+		t.Fatal("expect closed:", state)
+	}
+	if err := db.Exec("create table bk_item (id integer primary key)").Error; err != nil {
+		t.Fatal(err)
+	}
+	// 复用的语句在熔断打开后不能重复释放上一次的名额
+	reused := db.Table("bk_item").Where("id > ?", 0)
+	var total int64
+	if err := reused.Count(&total).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Exec("select * from missing_table").Error; err == nil {
+			t.Fatal("query should fail")
+		}
+	}
+	err := db.Raw("select 1").Scan(&n).Error
+	var rejected *lib.DBRejectedError
+	if !errors.Is(err, lib.ErrDBBreakerOpen) || !errors.As(err, &rejected) || rejected.Pool != "breaker" || rejected.RetryAfter <= 0 {
+		t.Fatal("expect breaker open:", err)
+	}
+	reusedErr := make(chan error, 1)
+	go func() {
+		var ids []int
+		reusedErr <- reused.Find(&ids).Error
+	}()
+	select {
+	case err := <-reusedErr:
+		if !errors.Is(err, lib.ErrDBBreakerOpen) {
+			t.Fatal("reused statement should be rejected:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reused statement blocked after breaker opened")
+	}
+	if _, err := app.DBExec(ctx, "breaker", "select 1"); !errors.Is(err, lib.ErrDBBreakerOpen) {
+		t.Fatal("raw helpers should be guarded:", err)
+	}
+	if state := app.DBHealth()["breaker"].Breaker; state != lib.DBBreakerOpen {
+		t.Fatal("expect open:", state)
+	}
+	if err := app.ModuleHealth(ctx)["mysql"]; !errors.Is(err, lib.ErrDBBreakerOpen) {
+		t.Fatal("module health should report breaker:", err)
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	if err := db.Raw("select 1").Scan(&n).Error; err != nil {
+		t.Fatal("half open probe should pass:", err)
+	}
+	if state := app.DBHealth()["breaker"].Breaker; state != lib.DBBreakerClosed {
+		t.Fatal("expect closed after probe:", state)
+	}
+	if state := app.DBHealth()["wait"].Breaker; state != "" {
+		t.Fatal("breaker not configured:", state)
+	}
+
+	// 唯一的连接被慢查询占用时,等待超过max_conn_wait_ms直接失败
+	waitDB, _ := app.GetGormPool("wait")
+	if err := waitDB.Exec("create table wait_item (id integer primary key)").Error; err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var count []int
+		waitDB.Raw("with recursive c(x) as (select 1 union all select x+1 from c where x < 5000000) select count(*) from c").Find(&count)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	err = waitDB.Raw("select 1").Scan(&n).Error
+	if !errors.Is(err, lib.ErrDBConnWaitTimeout) || time.Since(start) > time.Second {
+		t.Fatal("expect wait timeout:", err, time.Since(start))
+	}
+	// 写操作在gorm开启默认事务前等待名额
+	start = time.Now()
+	err = waitDB.Create(&waitItem{}).Error
+	if !errors.Is(err, lib.ErrDBConnWaitTimeout) || time.Since(start) > time.Second {
+		t.Fatal("create should wait timeout:", err, time.Since(start))
+	}
+	wg.Wait()
+	if err := waitDB.Raw("select 1").Scan(&n).Error; err != nil {
+		t.Fatal("conn should be released:", err)
+	}
+
+	// 调用方事务和未关闭的游标同样占用连接
+	tx := waitDB.Begin()
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	start = time.Now()
+	err = waitDB.Raw("select 1").Scan(&n).Error
+	if !errors.Is(err, lib.ErrDBConnWaitTimeout) || time.Since(start) > time.Second {
+		t.Fatal("query should wait timeout while tx holds conn:", err, time.Since(start))
+	}
+	if _, err := app.DBExec(ctx, "wait", "select 1"); !errors.Is(err, lib.ErrDBConnWaitTimeout) {
+		t.Fatal("raw helpers should wait timeout:", err)
+	}
+	if err := tx.Create(&waitItem{}).Error; err != nil {
+		t.Fatal("statements in tx should not wait:", err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+	rows, err := waitDB.Raw("select id from wait_item").Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDB.Raw("select 1").Scan(&n).Error; !errors.Is(err, lib.ErrDBConnWaitTimeout) {
+		t.Fatal("query should wait timeout while rows open:", err)
+	}
+	rows.Close()
+	if err := waitDB.Raw("select 1").Scan(&n).Error; err != nil {
+		t.Fatal("conn should be released after rows closed:", err)
+	}
+}
+
+// 只配置min_requests时其余参数取默认值,错误率达到0.5熔断
+func TestDBBreakerDefaults(t *testing.T) {
+	app := newSqliteApp(t, "breaker_default", fmt.Sprintf(`[list.breaker_default]
+driver_name = "sqlite"
+data_source_name = %q
+[list.breaker_default.breaker]
+min_requests = 2
+`, filepath.Join(t.TempDir(), "default.db")))
+	db, _ := app.GetGormPool("breaker_default")
+	for i := 0; i < 2; i++ {
+		if err := db.Exec("select * from missing_table").Error; err == nil {
+			t.Fatal("query should fail")
+		}
+	}
+	var n int
+	if err := db.Raw("select 1").Scan(&n).Error; !errors.Is(err, lib.ErrDBBreakerOpen) {
+		t.Fatal("expect breaker open with default error_rate:", err)
+	}
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"path/filepath"
+	"testing"
+)
+
+type driverUser struct {
+	Id   int    `gorm:"primary_key"`
+	Name string `gorm:"column:name"`
+}
+
+func (driverUser) TableName() string {
+	return "driver_user"
+}
+
+func TestSqliteDriver(t *testing.T) {
+	dbDir := t.TempDir()
+	primary := filepath.Join(dbDir, "primary.db")
+	replica := filepath.Join(dbDir, "replica.db")
+	app := newSqliteApp(t, "sqlite", fmt.Sprintf("[list.default]\ndriver_name = \"sqlite\"\ndata_source_name = %q\nmax_open_conn = 1\n"+
+		"[[list.default.replicas]]\ndata_source_name = %q\n", primary, replica))
+
+	writePool, err := app.GetDBPool("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readPool, err := app.GetDBReadPool("default")
+	if err != nil || readPool == writePool {
+		t.Fatal("read pool should be the replica:", err)
+	}
+	ddl := "create table driver_user (id integer primary key, name text)"
+	if _, err := writePool.Exec(ddl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPool.Exec(ddl); err != nil {
+		t.Fatal(err)
+	}
+
+	db := app.GORMDefaultPool
+	if err := db.Create(&driverUser{Name: "nice"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	var users []driverUser
+	if err := db.Find(&users).Error; err != nil || len(users) != 0 {
+		t.Fatal("read should go to replica:", users, err)
+	}
+	if err := lib.UsePrimary(db).Find(&users).Error; err != nil || len(users) != 1 {
+		t.Fatal("UsePrimary should read primary:", users, err)
+	}
+
+	rows, err := lib.DBPoolLogQuery(lib.NewTrace(), writePool, "select name from driver_user where id = ?", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		t.Fatal("expect one row")
+	}
+}
+
+type failingDialector struct {
+	gorm.Dialector
+}
+
+func (failingDialector) Initialize(*gorm.DB) error {
+	return errors.New("dialector failed")
+}
+
+// 初始化失败时,失败的和之前已打开的连接池都要关闭
+func TestInitDBPoolCloseOnError(t *testing.T) {
+	var pools []*sql.DB
+	lib.RegisterDBDriver("leaky_ok", lib.DBDriver{SQLDriver: "sqlite3", Dialector: func(pool *sql.DB) gorm.Dialector {
+		pools = append(pools, pool)
+		return sqlite.New(sqlite.Config{Conn: pool})
+	}})
+	lib.RegisterDBDriver("leaky_fail", lib.DBDriver{SQLDriver: "sqlite3", Dialector: func(pool *sql.DB) gorm.Dialector {
+		pools = append(pools, pool)
+		return failingDialector{sqlite.New(sqlite.Config{Conn: pool})}
+	}})
+	dbDir := t.TempDir()
+	dir := newTestEnv(t, "leaky", map[string]string{
+		"base.toml": testBaseToml,
+		"mysql_map.toml": fmt.Sprintf("[list.ok]\ndriver_name = \"leaky_ok\"\ndata_source_name = %q\n"+
+			"[list.fail]\ndriver_name = \"leaky_fail\"\ndata_source_name = %q\n", filepath.Join(dbDir, "ok.db"), filepath.Join(dbDir, "fail.db")),
+	})
+	app := lib.New(lib.WithConfigPath(dir), lib.WithModulePolicy("mysql", lib.PolicyRequired))
+	t.Cleanup(app.Destroy)
+	if err := app.InitModule([]string{"mysql"}); err == nil {
+		t.Fatal("dialector failure should fail init")
+	}
+	if len(pools) == 0 {
+		t.Fatal("expect opened pools")
+	}
+	for i, pool := range pools {
+		if err := pool.Ping(); err == nil || err.Error() != "sql: database is closed" {
+			t.Fatal("pool should be closed:", i, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 可控制上下线的驱动,在线时转发给sqlite3
+type flakyDriver struct {
+	base driver.Driver
+	up   atomic.Bool
+}
+
+func (d *flakyDriver) Open(name string) (driver.Conn, error) {
+	if !d.up.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return d.base.Open(name)
+}
+
+func TestDBHealth(t *testing.T) {
+	sqliteDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &flakyDriver{base: sqliteDB.Driver()}
+	sqliteDB.Close()
+	sql.Register("flaky_sqlite3", flaky)
+	lib.RegisterDBDriver("flaky", lib.DBDriver{
+		SQLDriver: "flaky_sqlite3",
+		Dialector: func(pool *sql.DB) gorm.Dialector {
+			return postgres.New(postgres.Config{Conn: pool})
+		},
+	})
+	interval := lib.DBHealthCheckInterval
+	lib.DBHealthCheckInterval = 20 * time.Millisecond
+	t.Cleanup(func() { lib.DBHealthCheckInterval = interval })
+
+	app := newSqliteApp(t, "health", fmt.Sprintf("[list.default]\ndriver_name = \"flaky\"\ndata_source_name = %q\n",
+		filepath.Join(t.TempDir(), "health.db")))
+	if app.GORMDefaultPool == nil {
+		t.Fatal("gorm pool should exist while db is down")
+	}
+	status, ok := app.DBHealth()["default"]
+	if !ok || status.Up || status.Err == "" {
+		t.Fatal("expect default pool down:", status)
+	}
+
+	flaky.up.Store(true)
+	deadline := time.Now().Add(2 * time.Second)
+	for !app.DBHealth()["default"].Up {
+		if time.Now().After(deadline) {
+			t.Fatal("pool did not recover:", app.DBHealth())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var one int
+	if err := app.GORMDefaultPool.Raw("select 1").Scan(&one).Error; err != nil || one != 1 {
+		t.Fatal("query after recovery:", one, err)
+	}
+}
@@ -0,0 +1,81 @@
+package test
+
+import (
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/m17621679833/nice_base/lib"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQLFingerprint(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM `user` WHERE id IN (1, 2,3) AND name = 'a''b'": "select * from `user` where id in (?+) and name = ?",
+		"insert into t1 (a,b) values (1,'x'),(2,'y'),(3,'z');":          "insert into t1 (a,b) values (?+)",
+		"update  user2\n set score=score+1.5 where id=-7":                "update user2 set score=score+? where id=-?",
+	}
+	for sql, expect := range cases {
+		if fp := lib.SQLFingerprint(sql); fp != expect {
+			t.Errorf("SQLFingerprint(%q) = %q, expect %q", sql, fp, expect)
+		}
+	}
+}
+
+func TestDBMetrics(t *testing.T) {
+	app := newSqliteApp(t, "metrics", fmt.Sprintf("[list.default]\ndriver_name = \"sqlite\"\ndata_source_name = %q\nmax_open_conn = 4\n",
+		filepath.Join(t.TempDir(), "metrics.db")))
+
+	db := app.GORMDefaultPool
+	if err := db.Exec("create table metric_user (id integer primary key, name text)").Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		db.Exec("insert into metric_user (name) values (?)", fmt.Sprintf("user%d", i))
+	}
+	db.Exec("select * from missing_table")
+	lib.ObserveDBQuery("default", "insert into metric_user (id) values (1)", time.Millisecond, &mysql.MySQLError{Number: 1062})
+
+	rec := httptest.NewRecorder()
+	lib.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, expect := range []string{
+		`nice_db_query_duration_seconds_count{fingerprint="insert into metric_user (name) values (?)",pool="default"} 3`,
+		`nice_db_query_errors_total{errno="1062",pool="default"} 1`,
+		`nice_db_query_errors_total{errno="other",pool="default"} 1`,
+	} {
+		if !strings.Contains(string(body), expect) {
+			t.Fatalf("missing %v in metrics:\n%s", expect, body)
+		}
+	}
+	if !regexp.MustCompile(`nice_db_max_open_connections{app="app\d+",env="metrics",pool="default"} 4`).Match(body) {
+		t.Fatalf("missing pool stats in metrics:\n%s", body)
+	}
+
+	// 同一进程内相同env/pool的App不应产生重复序列
+	newMysqlApp(t, app.ConfEnvPath+"/")
+	if _, err := lib.MetricsRegistry.Gather(); err != nil {
+		t.Fatal("gather with two apps:", err)
+	}
+
+	max := lib.DBMetricsMaxFingerprints
+	lib.DBMetricsMaxFingerprints = 1
+	defer func() { lib.DBMetricsMaxFingerprints = max }()
+	db.Exec("insert into metric_user (name) values (?)", "user3")
+	lib.ObserveDBQuery("default", "delete from metric_user where id = 9", time.Millisecond, nil)
+	rec = httptest.NewRecorder()
+	lib.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ = io.ReadAll(rec.Body)
+	for _, expect := range []string{
+		`nice_db_query_duration_seconds_count{fingerprint="insert into metric_user (name) values (?)",pool="default"} 4`,
+		`nice_db_query_duration_seconds_count{fingerprint="other",pool="default"} 1`,
+	} {
+		if !strings.Contains(string(body), expect) {
+			t.Fatalf("missing %v in metrics:\n%s", expect, body)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"gorm.io/gorm"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestMigrate(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "migrate.db")
+	dir := newTestEnv(t, "migrate", map[string]string{
+		"base.toml": testBaseToml,
+		"mysql_map.toml": fmt.Sprintf("[list.default]\ndriver_name = \"sqlite\"\ndata_source_name = %q\nmax_open_conn = 1\n",
+			dbFile),
+	})
+	files := fstest.MapFS{
+		"0001_create_user.up.sql": {Data: []byte("-- user table; with comment\ncreate table mg_user (id integer primary key, name text default 'a;b');\n" +
+			"insert into mg_user (name) values ('init');\n")},
+		"0001_create_user.down.sql": {Data: []byte("drop table mg_user;")},
+		"README.md":                 {Data: []byte("ignored")},
+	}
+	ctx := context.Background()
+	newApp := func(opts ...lib.Option) *lib.App {
+		app := lib.New(append([]lib.Option{lib.WithConfigPath(dir), lib.WithModulePolicy("mysql", lib.PolicyRequired)}, opts...)...)
+		if err := app.LoadMigrations("default", files); err != nil {
+			t.Fatal(err)
+		}
+		if err := app.RegisterMigration("default", lib.Migration{
+			Version: 2,
+			Name:    "add_age",
+			Up: func(tx *gorm.DB) error {
+				return tx.Exec("alter table mg_user add column age integer").Error
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Exec("alter table mg_user drop column age").Error
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return app
+	}
+
+	app := newApp(lib.WithAutoMigrate())
+	if err := app.InitModule([]string{"mysql"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.RegisterMigration("default", lib.Migration{Version: 2, Name: "dup", UpSQL: "select 1"}); err == nil {
+		t.Fatal("duplicate version should fail")
+	}
+	var n int64
+	if err := app.GORMDefaultPool.Raw("select count(*) from mg_user where age is null").Scan(&n).Error; err != nil || n != 1 {
+		t.Fatal("auto migrate:", err, n)
+	}
+	statuses, err := app.MigrationStatuses(ctx, "default")
+	if err != nil || len(statuses) != 2 || !statuses[0].Applied || !statuses[1].Applied || statuses[0].Name != "create_user" {
+		t.Fatalf("status: %v %+v", err, statuses)
+	}
+	// 重复执行不应再应用
+	if err := app.MigrateUp(ctx, "default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 另一个实例持有锁时等待超时
+	timeout := lib.MigrateLockTimeout
+	lib.MigrateLockTimeout = 10 * time.Millisecond
+	defer func() { lib.MigrateLockTimeout = timeout }()
+	app.GORMDefaultPool.Exec("insert into schema_migrations_lock (id, locked_by, locked_at) values (1, 'other', ?)", time.Now())
+	if err := app.MigrateDown(ctx, "default", 1); !errors.Is(err, lib.ErrMigrateLocked) {
+		t.Fatal("expect locked:", err)
+	}
+	// 过期的锁可以抢占
+	app.GORMDefaultPool.Exec("update schema_migrations_lock set locked_at = ?", time.Now().Add(-time.Hour))
+
+	var out bytes.Buffer
+	for _, steps := range []string{"0", "-1"} {
+		if err := app.RunMigrateCommand(ctx, []string{"down", "-steps", steps}, &out); err == nil {
+			t.Fatal("non-positive steps should be rejected:", steps)
+		}
+	}
+	if err := app.RunMigrateCommand(ctx, []string{"down", "-steps", "1"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.RunMigrateCommand(ctx, []string{"status"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "1\tcreate_user\t") || lines[1] != "2\tadd_age\tpending" {
+		t.Fatalf("status output: %q", out.String())
+	}
+	if err := app.RunMigrateCommand(ctx, []string{"down", "-steps", "5"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.GORMDefaultPool.Exec("select 1 from mg_user").Error; err == nil {
+		t.Fatal("mg_user should be dropped")
+	}
+	if err := app.RunMigrateCommand(ctx, []string{"sideways"}, &out); err == nil {
+		t.Fatal("unknown command should fail")
+	}
+	app.Destroy()
+
+	// 失败的迁移回滚且不记录版本,启动失败
+	app = newApp(lib.WithAutoMigrate())
+	app.RegisterMigration("default", lib.Migration{Version: 3, Name: "broken", UpSQL: "create table mg_ok (id integer); select * from missing_table"})
+	if err := app.InitModule([]string{"mysql"}); err == nil || !strings.Contains(err.Error(), "3_broken") {
+		t.Fatal("broken migration should abort startup:", err)
+	}
+	app = newApp()
+	if err := app.InitModule([]string{"mysql"}); err != nil {
+		t.Fatal(err)
+	}
+	defer app.Destroy()
+	statuses, err = app.MigrationStatuses(ctx, "default")
+	if err != nil || len(statuses) != 2 || !statuses[1].Applied {
+		t.Fatalf("status after failure: %v %+v", err, statuses)
+	}
+	if err := app.GORMDefaultPool.Exec("select 1 from mg_ok").Error; err == nil {
+		t.Fatal("failed migration should be rolled back")
+	}
+}
+
+func TestMigrateLockHeartbeat(t *testing.T) {
+	ttl, heartbeat, timeout := lib.MigrateLockTTL, lib.MigrateLockHeartbeat, lib.MigrateLockTimeout
+	lib.MigrateLockTTL = 200 * time.Millisecond
+	lib.MigrateLockHeartbeat = 50 * time.Millisecond
+	lib.MigrateLockTimeout = 400 * time.Millisecond
+	t.Cleanup(func() { lib.MigrateLockTTL, lib.MigrateLockHeartbeat, lib.MigrateLockTimeout = ttl, heartbeat, timeout })
+	ctx := context.Background()
+	slow := newSqliteApp(t, "migrate_heartbeat", fmt.Sprintf("[list.default]\ndriver_name = \"sqlite\"\ndata_source_name = %q\n",
+		filepath.Join(t.TempDir(), "heartbeat.db")))
+	other := newMysqlApp(t, slow.ConfEnvPath+"/")
+	for _, app := range []*lib.App{slow, other} {
+		app.RegisterMigration("default", lib.Migration{Version: 1, Name: "slow", Up: func(tx *gorm.DB) error {
+			time.Sleep(800 * time.Millisecond)
+			return nil
+		}})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- slow.MigrateUp(ctx, "default")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// 迁移耗时超过TTL,持有者持续刷新锁,其他实例不能抢占
+	if err := other.MigrateUp(ctx, "default"); !errors.Is(err, lib.ErrMigrateLocked) {
+		t.Fatal("lock should stay held past ttl:", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 读取过期锁后持有者刷新了锁,不能再抢占
+func TestMigrateLockRefreshedBeforeTakeover(t *testing.T) {
+	timeout := lib.MigrateLockTimeout
+	lib.MigrateLockTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { lib.MigrateLockTimeout = timeout })
+	ctx := context.Background()
+	app := newSqliteApp(t, "migrate_takeover", fmt.Sprintf("[list.default]\ndriver_name = \"sqlite\"\ndata_source_name = %q\n",
+		filepath.Join(t.TempDir(), "takeover.db")))
+	holder := newMysqlApp(t, app.ConfEnvPath+"/")
+	if err := app.MigrateUp(ctx, "default"); err != nil {
+		t.Fatal(err)
+	}
+	holder.GORMDefaultPool.Exec("insert into schema_migrations_lock (id, locked_by, locked_at) values (1, 'holder', ?)", time.Now().Add(-time.Hour))
+	var refreshed sync.Once
+	app.GORMDefaultPool.Callback().Delete().Before("gorm:delete").Register("test:refresh_lock", func(db *gorm.DB) {
+		if db.Statement.Table == "schema_migrations_lock" {
+			refreshed.Do(func() {
+				holder.GORMDefaultPool.Exec("update schema_migrations_lock set locked_at = ? where locked_by = 'holder'", time.Now())
+			})
+		}
+	})
+	if err := app.MigrateUp(ctx, "default"); !errors.Is(err, lib.ErrMigrateLocked) {
+		t.Fatal("refreshed lock should not be taken over:", err)
+	}
+}
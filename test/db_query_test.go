@@ -0,0 +1,70 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type queryBase struct {
+	Id int64 `db:"id"`
+}
+
+type queryUser struct {
+	queryBase
+	Name      string         `gorm:"column:user_name"`
+	Nick      sql.NullString `json:"nick"`
+	CreatedAt string
+}
+
+func TestDBQuery(t *testing.T) {
+	app := newSqliteApp(t, "query", fmt.Sprintf("[list.default]\ndriver_name = \"sqlite\"\ndata_source_name = %q\nquery_timeout = 200\n",
+		filepath.Join(t.TempDir(), "query.db")))
+	ctx := lib.SetTraceContext(context.Background(), lib.NewTrace())
+
+	if _, err := app.DBExec(ctx, "default", "create table query_user (id integer primary key, user_name text, nick text, created_at text, extra text)"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := app.DBExec(ctx, "default", "insert into query_user (user_name, nick, created_at) values (?, ?, ?), (?, null, ?)",
+		"alice", "al", "2024-05-11", "bob", "2024-05-12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := result.RowsAffected(); n != 2 {
+		t.Fatal("affected rows:", n)
+	}
+
+	users, err := lib.AppDBQueryStructs[queryUser](app, ctx, "default", "select * from query_user order by id")
+	if err != nil || len(users) != 2 {
+		t.Fatal(users, err)
+	}
+	if users[0].Id != 1 || users[0].Name != "alice" || users[0].Nick.String != "al" || users[0].CreatedAt != "2024-05-11" || users[1].Nick.Valid {
+		t.Fatal("unexpected scan result:", users)
+	}
+
+	var user queryUser
+	if err := app.DBQueryRow(ctx, "default", &user, "select id, user_name from query_user where user_name = ?", "bob"); err != nil || user.Id != 2 {
+		t.Fatal(user, err)
+	}
+	var count int
+	if err := app.DBQueryRow(lib.PrimaryContext(ctx), "default", &count, "select count(*) from query_user"); err != nil || count != 2 {
+		t.Fatal(count, err)
+	}
+	if err := app.DBQueryRow(ctx, "default", &user, "select * from query_user where id = ?", 100); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatal("expect ErrNoRows:", err)
+	}
+	if _, err := app.DBExec(ctx, "default", "insert into missing_table values (1)"); err == nil {
+		t.Fatal("expect exec error")
+	}
+
+	slow := "with recursive c(x) as (select 1 union all select x+1 from c where x < 100000000) select count(*) from c"
+	start := time.Now()
+	if err := app.DBQueryRow(ctx, "default", &count, slow); err == nil || time.Since(start) > 2*time.Second {
+		t.Fatal("expect query timeout:", err, time.Since(start))
+	}
+}
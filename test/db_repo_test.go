@@ -0,0 +1,114 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"gorm.io/gorm"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type repoUser struct {
+	Id        int64      `gorm:"column:id;primary_key;autoIncrement"`
+	Name      string     `gorm:"column:name"`
+	Score     int        `gorm:"column:score"`
+	Version   int        `gorm:"column:version"`
+	DeletedAt *time.Time `gorm:"column:deleted_at"`
+}
+
+func (repoUser) TableName() string {
+	return "repo_user"
+}
+
+func TestRepo(t *testing.T) {
+	app := newSqliteApp(t, "repo", fmt.Sprintf("[list.default]\ndriver_name = \"sqlite\"\ndata_source_name = %q\n",
+		filepath.Join(t.TempDir(), "repo.db")))
+	if err := app.GORMDefaultPool.Exec("create table repo_user (id integer primary key autoincrement, name text, score integer, version integer, deleted_at datetime)").Error; err != nil {
+		t.Fatal(err)
+	}
+	batch := lib.RepoBatchSize
+	lib.RepoBatchSize = 2
+	defer func() { lib.RepoBatchSize = batch }()
+	ctx := lib.SetTraceContext(context.Background(), lib.NewTrace())
+	repo := lib.AppNewRepo[repoUser](app, "default", lib.WithRepoSoftDelete("deleted_at"), lib.WithRepoVersion("version"))
+
+	users := make([]repoUser, 5)
+	for i := range users {
+		users[i] = repoUser{Name: fmt.Sprintf("u%d", i+1), Score: i % 2}
+	}
+	if n, err := repo.BatchInsert(ctx, users); err != nil || n != 5 || users[4].Id != 5 {
+		t.Fatal("batch insert:", n, err, users)
+	}
+	if u, err := repo.Get(ctx, 3); err != nil || u.Name != "u3" {
+		t.Fatal("get:", u, err)
+	}
+
+	page, err := repo.List(ctx, lib.PageQuery{Page: 2, Size: 2})
+	if err != nil || page.Total != 5 || len(page.Items) != 2 || page.Items[0].Id != 3 {
+		t.Fatal("offset page:", page, err)
+	}
+	page, err = repo.List(ctx, lib.PageQuery{Size: 10}, lib.RepoWhere("score = ?", 1))
+	if err != nil || page.Total != 2 || len(page.Items) != 2 {
+		t.Fatal("filter:", page, err)
+	}
+	var ids []int64
+	query := lib.PageQuery{Size: 2, Keyset: true, Desc: true}
+	for {
+		page, err := repo.List(ctx, query)
+		if err != nil || page.Total != 5 {
+			t.Fatal("keyset:", page, err)
+		}
+		for _, u := range page.Items {
+			ids = append(ids, u.Id)
+		}
+		if page.Next == nil {
+			break
+		}
+		query.After = page.Next
+	}
+	if fmt.Sprint(ids) != "[5 4 3 2 1]" {
+		t.Fatal("keyset ids:", ids)
+	}
+
+	u, _ := repo.Get(ctx, 1)
+	stale := *u
+	u.Score = 10
+	if err := repo.Update(ctx, u, "score"); err != nil || u.Version != 1 {
+		t.Fatal("update:", u, err)
+	}
+	stale.Score = 20
+	if err := repo.Update(ctx, &stale); !errors.Is(err, lib.ErrRepoVersionConflict) {
+		t.Fatal("stale update should conflict:", err)
+	}
+	if u, _ := repo.Get(ctx, 1); u.Score != 10 || u.Version != 1 {
+		t.Fatal("after update:", u)
+	}
+
+	if err := repo.Upsert(ctx, &repoUser{Id: 2, Name: "u2-new", Score: 7}, "name"); err != nil {
+		t.Fatal("upsert:", err)
+	}
+	if u, _ := repo.Get(ctx, 2); u.Name != "u2-new" || u.Score != 1 {
+		t.Fatal("upsert should only update name:", u)
+	}
+	if err := repo.Upsert(ctx, &repoUser{Id: 6, Name: "u6"}); err != nil {
+		t.Fatal("upsert insert:", err)
+	}
+
+	if err := repo.Delete(ctx, 6); err != nil {
+		t.Fatal("delete:", err)
+	}
+	if _, err := repo.Get(ctx, 6); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatal("deleted row should be hidden:", err)
+	}
+	if err := repo.Delete(ctx, 6); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatal("delete twice:", err)
+	}
+	var raw int64
+	app.GORMDefaultPool.Table("repo_user").Where("id = 6 and deleted_at is not null").Count(&raw)
+	if page, err := repo.List(ctx, lib.PageQuery{}); err != nil || page.Total != 5 || raw != 1 {
+		t.Fatal("soft delete:", page, err, raw)
+	}
+}
@@ -0,0 +1,183 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"gorm.io/gorm"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type shardOrder struct {
+	Id     int64  `gorm:"primary_key"`
+	UserId int64  `gorm:"column:user_id"`
+	Item   string `gorm:"column:item"`
+}
+
+func (shardOrder) TableName() string {
+	return "orders"
+}
+
+func TestShardDB(t *testing.T) {
+	tmp := t.TempDir()
+	app := newSqliteApp(t, "shard", fmt.Sprintf(`[list.default]
+driver_name = "sqlite"
+data_source_name = %q
+[list.order0]
+driver_name = "sqlite"
+data_source_name = %q
+[list.order1]
+driver_name = "sqlite"
+data_source_name = %q
+
+[shards.orders]
+shard_key = "user_id"
+table = "orders"
+table_count = 4
+[[shards.orders.nodes]]
+pool = "order0"
+tables = "0-1"
+[[shards.orders.nodes]]
+pool = "order1"
+tables = "2-3"
+
+[shards.profile]
+shard_key = "name"
+table = "profile"
+algorithm = "hash_range"
+table_count = 4
+slots = 16
+suffix_format = "_%%d"
+[[shards.profile.nodes]]
+pool = "order0"
+tables = "0-3"
+`, filepath.Join(tmp, "default.db"), filepath.Join(tmp, "order0.db"), filepath.Join(tmp, "order1.db")))
+	ctx := context.Background()
+
+	shards, err := app.Shards("orders")
+	if err != nil || len(shards) != 4 || shards[1].Pool != "order0" || shards[2].Pool != "order1" || shards[3].Table != "orders_03" {
+		t.Fatalf("shards: %v %+v", err, shards)
+	}
+	for _, shard := range shards {
+		db, _ := app.GetGormPool(shard.Pool)
+		if err := db.Exec(fmt.Sprintf("create table %s (id integer primary key, user_id integer, item text)", shard.Table)).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for userId := int64(1); userId <= 8; userId++ {
+		order := &shardOrder{UserId: userId, Item: fmt.Sprint("item", userId)}
+		db, err := app.ShardDB(ctx, "orders", order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Create(order).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 同一个*gorm.DB可重复使用
+	db, err := app.ShardDB(ctx, "orders", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []shardOrder
+	if err := db.Where("user_id = ?", 6).Find(&found).Error; err != nil || len(found) != 1 || found[0].Item != "item6" {
+		t.Fatal("find:", err, found)
+	}
+	var n int64
+	if err := db.Count(&n).Error; err != nil || n != 2 {
+		t.Fatal("orders_02 should hold user 2 and 6:", err, n)
+	}
+	if shard, _ := app.ShardOf("orders", uint8(7)); shard.Table != "orders_03" || shard.Pool != "order1" {
+		t.Fatalf("%+v", shard)
+	}
+
+	all, err := lib.AppShardFind[shardOrder](app, ctx, "orders", func(db *gorm.DB) *gorm.DB {
+		return db.Where("user_id > ?", 2)
+	})
+	if err != nil || len(all) != 6 {
+		t.Fatal("scatter:", err, len(all))
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].UserId < all[j].UserId })
+	if all[0].UserId != 3 || all[5].UserId != 8 {
+		t.Fatalf("%+v", all)
+	}
+	err = app.ShardScatter(ctx, "orders", func(ctx context.Context, db *gorm.DB, shard lib.Shard) error {
+		if shard.Index == 1 {
+			return db.Exec("select * from missing").Error
+		}
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "orders_01") {
+		t.Fatal("scatter error should name the shard:", err)
+	}
+
+	concurrency := lib.ShardScatterConcurrency
+	lib.ShardScatterConcurrency = 1
+	cancelCtx, cancel := context.WithCancel(ctx)
+	err = app.ShardScatter(cancelCtx, "orders", func(ctx context.Context, db *gorm.DB, shard lib.Shard) error {
+		if shard.Index == 0 {
+			cancel()
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	})
+	lib.ShardScatterConcurrency = concurrency
+	if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "orders_01") {
+		t.Fatal("scatter should stop waiting for slots after cancel:", err)
+	}
+	for value, table := range map[int64]string{math.MinInt64: "orders_00", -5: "orders_01", -7: "orders_03"} {
+		if shard, err := app.ShardOf("orders", value); err != nil || shard.Table != table {
+			t.Fatal("negative key:", value, err, shard)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		shard, err := app.ShardOf("profile", name)
+		if err != nil || !strings.HasPrefix(shard.Table, "profile_") {
+			t.Fatal(err, shard)
+		}
+		again, _ := app.ShardOf("profile", []byte(name))
+		if again != shard {
+			t.Fatal("routing should be stable", shard, again)
+		}
+		seen[shard.Table] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("hash_range should spread keys:", seen)
+	}
+	if _, err := app.ShardDB(ctx, "orders", 1.5); err == nil {
+		t.Fatal("float key should fail")
+	}
+	if _, err := app.ShardDB(ctx, "missing", 1); err == nil {
+		t.Fatal("unknown shard should fail")
+	}
+}
+
+func TestShardConfError(t *testing.T) {
+	tmp := t.TempDir()
+	for name, nodes := range map[string]string{
+		"gap":     "[[shards.orders.nodes]]\npool = \"default\"\ntables = \"0-2\"\n",
+		"overlap": "[[shards.orders.nodes]]\npool = \"default\"\ntables = \"0-3\"\n[[shards.orders.nodes]]\npool = \"default\"\ntables = \"3\"\n",
+		"pool":    "[[shards.orders.nodes]]\npool = \"nope\"\ntables = \"0-3\"\n",
+	} {
+		dir := newTestEnv(t, "shard_"+name, map[string]string{
+			"base.toml": testBaseToml,
+			"mysql_map.toml": fmt.Sprintf("[list.default]\ndriver_name = \"sqlite\"\ndata_source_name = %q\n"+
+				"[shards.orders]\nshard_key = \"user_id\"\ntable = \"orders\"\ntable_count = 4\n%s",
+				filepath.Join(tmp, name+".db"), nodes),
+		})
+		app := lib.New(lib.WithConfigPath(dir), lib.WithModulePolicy("mysql", lib.PolicyRequired))
+		if err := app.InitModule([]string{"mysql"}); err == nil {
+			app.Destroy()
+			t.Fatal(name, "should fail")
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestSlowQueryReport(t *testing.T) {
+	app := newSqliteApp(t, "slow", fmt.Sprintf("[list.default]\ndriver_name = \"sqlite\"\ndata_source_name = %q\nslow_threshold_ms = 1\n",
+		filepath.Join(t.TempDir(), "slow.db")))
+
+	slow := "with recursive c(x) as (select 1 union all select x+1 from c where x < %d) select count(*) from c"
+	var count int
+	for _, n := range []int{200000, 300000, 400000} {
+		if err := app.GORMDefaultPool.Raw(fmt.Sprintf(slow, n)).Scan(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.DBQueryRow(context.Background(), "default", &count, fmt.Sprintf(slow, 500000)); err != nil {
+		t.Fatal(err)
+	}
+	app.GORMDefaultPool.Raw("select 1").Scan(&count)
+
+	rec := httptest.NewRecorder()
+	app.SlowQueryHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/slow?n=5", nil))
+	var result struct {
+		Current []lib.SlowQueryStat `json:"current"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err, rec.Body.String())
+	}
+	if len(result.Current) != 1 {
+		t.Fatal("expect one fingerprint:", rec.Body.String())
+	}
+	stat := result.Current[0]
+	if stat.Fingerprint != lib.SQLFingerprint(fmt.Sprintf(slow, 1)) || stat.Count != 4 || stat.Pool != "default" ||
+		stat.MaxMs < stat.P95Ms || stat.TotalMs < stat.MaxMs || stat.P95Ms <= 0 {
+		t.Fatal("unexpected stat:", stat)
+	}
+}
@@ -0,0 +1,139 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/m17621679833/nice_base/lib"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTenantDB(t *testing.T) {
+	tmp := t.TempDir()
+	interval := lib.TenantEvictInterval
+	lib.TenantEvictInterval = 50 * time.Millisecond
+	t.Cleanup(func() { lib.TenantEvictInterval = interval })
+	app := newSqliteApp(t, "tenant", fmt.Sprintf(`[list.default]
+driver_name = "sqlite"
+data_source_name = %q
+[tenants]
+data_source_template = %q
+idle_timeout = 1
+[tenants.list.shared]
+pool = "default"
+[tenants.list.vip]
+schema = "vip_schema"
+`, filepath.Join(tmp, "default.db"), filepath.Join(tmp, "tenant_{tenant}.db")))
+	ctx := lib.SetTraceContext(context.Background(), lib.NewTrace())
+
+	if _, err := app.TenantDB(ctx); !errors.Is(err, lib.ErrNoTenant) {
+		t.Fatal("missing tenant:", err)
+	}
+	if _, err := app.TenantDB(lib.SetTenantContext(ctx, "../x")); err == nil {
+		t.Fatal("invalid tenant id should fail")
+	}
+	type tenantKey string
+	if lib.GetTenantId(context.WithValue(lib.SetTenantContext(ctx, "acme"), tenantKey("tenant"), "other")) != "acme" {
+		t.Fatal("tenant should only be read from its own ctx key")
+	}
+
+	app.GORMDefaultPool.Exec("create table tn_item (id integer primary key, name text)")
+	app.GORMDefaultPool.Exec("insert into tn_item (name) values ('default')")
+	shared, err := app.TenantDB(lib.SetTenantContext(ctx, "shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := shared.Raw("select name from tn_item").Scan(&name).Error; err != nil || name != "default" {
+		t.Fatal("shared tenant should use default pool:", name, err)
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	lib.SetGinTenant(c, "acme")
+	acme, err := app.TenantDB(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme.Exec("create table tn_item (id integer primary key, name text)")
+	acme.Exec("insert into tn_item (name) values ('acme')")
+	if _, err := os.Stat(filepath.Join(tmp, "tenant_acme.db")); err != nil {
+		t.Fatal("acme pool should be created lazily:", err)
+	}
+	if _, err := app.TenantDB(lib.SetTenantContext(ctx, "vip")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "tenant_vip_schema.db")); err != nil {
+		t.Fatal("vip should use its schema:", err)
+	}
+
+	// 持续使用的连接池不会因为超过idle_timeout被回收
+	for i := 0; i < 5; i++ {
+		time.Sleep(300 * time.Millisecond)
+		if err := acme.Raw("select name from tn_item").Scan(&name).Error; err != nil {
+			t.Fatal("tenant pool in use should stay open:", err)
+		}
+	}
+	time.Sleep(1300 * time.Millisecond)
+	if sqlDB, _ := acme.DB(); sqlDB.Ping() == nil {
+		t.Fatal("unused tenant pool should be evicted after idle_timeout")
+	}
+	acme, err = app.TenantDB(lib.SetTenantContext(ctx, "acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acme.Raw("select name from tn_item").Scan(&name).Error; err != nil || name != "acme" {
+		t.Fatal("reopened tenant pool:", name, err)
+	}
+
+	var wg sync.WaitGroup
+	pools := make([]*sql.DB, 8)
+	for i := range pools {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if db, err := app.TenantDB(lib.SetTenantContext(ctx, "burst")); err == nil {
+				pools[i], _ = db.DB()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, pool := range pools {
+		if pool == nil || pool != pools[0] {
+			t.Fatal("concurrent first use should open one pool:", pools)
+		}
+	}
+
+	app.SetTenantResolver(func(ctx context.Context) (string, error) {
+		return "shared", nil
+	})
+	if db, err := app.TenantDB(ctx); err != nil || db.Raw("select name from tn_item").Scan(&name).Error != nil || name != "default" {
+		t.Fatal("custom resolver:", name, err)
+	}
+	// 请求处理中并发替换resolver
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			app.SetTenantResolver(func(ctx context.Context) (string, error) {
+				return "shared", nil
+			})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := app.TenantDB(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	app.SetTenantResolver(nil)
+	if _, err := app.TenantDB(ctx); !errors.Is(err, lib.ErrNoTenant) {
+		t.Fatal("nil resolver should restore default:", err)
+	}
+}
@@ -0,0 +1,91 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/m17621679833/nice_base/lib"
+	"gorm.io/gorm"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type txUser struct {
+	Id   int    `gorm:"primary_key"`
+	Name string `gorm:"column:name"`
+}
+
+func (txUser) TableName() string {
+	return "tx_user"
+}
+
+func TestWithTx(t *testing.T) {
+	app := newSqliteApp(t, "tx", fmt.Sprintf("[list.default]\ndriver_name = \"sqlite\"\ndata_source_name = %q\nmax_open_conn = 1\n",
+		filepath.Join(t.TempDir(), "tx.db")))
+	if err := app.GORMDefaultPool.Exec("create table tx_user (id integer primary key, name text)").Error; err != nil {
+		t.Fatal(err)
+	}
+	interval := lib.TxRetryMinInterval
+	lib.TxRetryMinInterval = time.Millisecond
+	defer func() { lib.TxRetryMinInterval = interval }()
+	ctx := lib.SetTraceContext(context.Background(), lib.NewTrace())
+	count := func() int64 {
+		var n int64
+		app.GORMDefaultPool.Model(&txUser{}).Count(&n)
+		return n
+	}
+
+	if err := app.WithTx(ctx, "default", func(tx *gorm.DB) error {
+		return tx.Create(&txUser{Name: "commit"}).Error
+	}); err != nil || count() != 1 {
+		t.Fatal("commit:", err, count())
+	}
+
+	errBiz := errors.New("biz error")
+	if err := app.WithTx(ctx, "default", func(tx *gorm.DB) error {
+		tx.Create(&txUser{Name: "rollback"})
+		return errBiz
+	}); !errors.Is(err, errBiz) || count() != 1 {
+		t.Fatal("rollback:", err, count())
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatal("panic should propagate:", r)
+			}
+		}()
+		app.WithTx(ctx, "default", func(tx *gorm.DB) error {
+			tx.Create(&txUser{Name: "panic"})
+			panic("boom")
+		})
+	}()
+	if count() != 1 {
+		t.Fatal("panic should roll back:", count())
+	}
+
+	attempts := 0
+	if err := app.WithTx(ctx, "default", func(tx *gorm.DB) error {
+		attempts++
+		if err := tx.Create(&txUser{Name: "deadlock"}).Error; err != nil {
+			return err
+		}
+		if attempts < 3 {
+			return fmt.Errorf("update stock:%w", &mysql.MySQLError{Number: 1213, Message: "Deadlock found"})
+		}
+		return nil
+	}); err != nil || attempts != 3 || count() != 2 {
+		t.Fatal("deadlock retry:", err, attempts, count())
+	}
+
+	attempts = 0
+	err := app.WithTx(ctx, "default", func(tx *gorm.DB) error {
+		attempts++
+		return &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}
+	})
+	if !lib.IsTxRetryable(err) || attempts != lib.TxMaxRetries+1 {
+		t.Fatal("lock wait retry:", err, attempts)
+	}
+}
@@ -0,0 +1,137 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateModel(t *testing.T) {
+	src, err := lib.GenerateModel("model", lib.ModelTable{
+		Name:    "test1",
+		Comment: "测试表",
+		Columns: []lib.ModelColumn{
+			{Name: "id", Type: "bigint(20) unsigned", Nullable: "NO", Comment: "自增id", PrimaryKey: true, AutoIncrement: true},
+			{Name: "name", Type: "varchar(255)", Nullable: "NO", Comment: "姓名\n全称"},
+			{Name: "score", Type: "decimal(10,2)", Nullable: "YES"},
+			{Name: "enabled", Type: "tinyint(1)", Nullable: "NO"},
+			{Name: "level", Type: "tinyint(4) unsigned", Nullable: "NO"},
+			{Name: "amount", Type: "numeric", Nullable: "NO"},
+			{Name: "created_at", Type: "datetime", Nullable: "NO"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"import \"time\"\n",
+		"// Test1 测试表\ntype Test1 struct {",
+		"Id        uint64    `json:\"id\" gorm:\"column:id;primary_key;autoIncrement\"` // 自增id",
+		"Name      string    `json:\"name\" gorm:\"column:name\"`                       // 姓名 全称",
+		"Score     *string   `json:\"score\" gorm:\"column:score\"`",
+		"Enabled   bool      `json:\"enabled\" gorm:\"column:enabled\"`",
+		"Level     int64     `json:\"level\" gorm:\"column:level\"`",
+		"Amount    string    `json:\"amount\" gorm:\"column:amount\"`",
+		"CreatedAt time.Time `json:\"created_at\" gorm:\"column:created_at\"`",
+		"func (t *Test1) TableName() string {\n\treturn \"test1\"\n}",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Fatalf("missing %q in:\n%s", want, src)
+		}
+	}
+}
+
+func TestMergeModelSource(t *testing.T) {
+	existing := `// Package model 业务模型
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// Test1 旧注释
+type Test1 struct {
+	Id        int64     ` + "`json:\"id\"`" + `
+	CreatedAt time.Time ` + "`json:\"created_at\"`" + `
+}
+
+func (t *Test1) TableName() string {
+	return "test1"
+}
+
+// 自定义方法不会被覆盖
+func (t *Test1) String() string {
+	return fmt.Sprint(t.Id)
+}
+`
+	generated, err := lib.GenerateModel("model", lib.ModelTable{Name: "test1", Columns: []lib.ModelColumn{
+		{Name: "id", Type: "int", Nullable: "NO", PrimaryKey: true},
+		{Name: "name", Type: "varchar(64)", Nullable: "NO"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := lib.MergeModelSource([]byte(existing), generated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(merged)
+	if _, err := parser.ParseFile(token.NewFileSet(), "", merged, 0); err != nil {
+		t.Fatal(err, out)
+	}
+	for _, want := range []string{"// Package model 业务模型\npackage model", "import \"fmt\"", "// Test1 表test1", "Name string", "// 自定义方法不会被覆盖\nfunc (t *Test1) String() string"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"旧注释", "\"time\"", "CreatedAt"} {
+		if strings.Contains(out, unwanted) {
+			t.Fatalf("unexpected %q in:\n%s", unwanted, out)
+		}
+	}
+	if strings.Count(out, "TableName") != 1 {
+		t.Fatalf("TableName duplicated:\n%s", out)
+	}
+	again, err := lib.MergeModelSource(merged, generated)
+	if err != nil || string(again) != out {
+		t.Fatalf("merge should be stable: %v\n%s", err, again)
+	}
+}
+
+func TestLoadModelTables(t *testing.T) {
+	app := newSqliteApp(t, "modelgen", fmt.Sprintf("[list.default]\ndriver_name = \"sqlite\"\ndata_source_name = %q\n",
+		filepath.Join(t.TempDir(), "modelgen.db")))
+	for _, ddl := range []string{
+		"create table user_info (id integer primary key, nick_name varchar(32) not null, birthday datetime)",
+		"create table user_log (id integer primary key, body text)",
+		"create table order_item (id integer primary key)",
+	} {
+		if err := app.GORMDefaultPool.Exec(ddl).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	tables, err := app.LoadModelTables(context.Background(), "default", []string{"user_*"}, []string{"user_log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 || tables[0].Name != "user_info" || len(tables[0].Columns) != 3 {
+		t.Fatalf("%+v", tables)
+	}
+	columns := tables[0].Columns
+	if !columns[0].PrimaryKey || !columns[0].AutoIncrement || columns[1].Nullable != "NO" || columns[2].Nullable != "YES" {
+		t.Fatalf("%+v", columns)
+	}
+	src, err := lib.GenerateModel("model", tables[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(src), "Birthday *time.Time") || !strings.Contains(string(src), "NickName string") {
+		t.Fatal(string(src))
+	}
+}
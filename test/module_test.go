@@ -0,0 +1,173 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"github.com/m17621679833/nice_base/lib"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type recordModule struct {
+	name    string
+	deps    []string
+	records *[]string
+}
+
+func (m *recordModule) Name() string {
+	return m.name
+}
+
+func (m *recordModule) DependsOn() []string {
+	return m.deps
+}
+
+func (m *recordModule) Init(ctx context.Context) error {
+	*m.records = append(*m.records, "init:"+m.name)
+	return nil
+}
+
+func (m *recordModule) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+func (m *recordModule) Close() error {
+	*m.records = append(*m.records, "close:"+m.name)
+	return nil
+}
+
+func TestModuleRegistry(t *testing.T) {
+	records := []string{}
+	dir := filepath.Join(t.TempDir(), "dev")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 独立的App,不受其他测试在默认App上初始化的模块影响
+	app := lib.New(lib.WithConfigProvider(lib.NewFileProvider(dir)))
+	app.RegisterModule(&recordModule{name: "reg_kafka", deps: []string{"reg_conf"}, records: &records})
+	app.RegisterModule(&recordModule{name: "reg_http", deps: []string{"reg_kafka", "reg_conf"}, records: &records})
+	app.RegisterModule(&recordModule{name: "reg_conf", records: &records})
+	app.RegisterModule(&recordModule{name: "reg_cycle_a", deps: []string{"reg_cycle_b"}, records: &records})
+	app.RegisterModule(&recordModule{name: "reg_cycle_b", deps: []string{"reg_cycle_a"}, records: &records})
+
+	if err := app.InitModule([]string{"reg_cycle_a"}); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatal("expect cycle error:", err)
+	}
+	if err := app.InitModule([]string{"reg_missing"}); err == nil {
+		t.Fatal("expect unknown module error")
+	}
+	if err := app.InitModule([]string{"reg_http"}); err != nil {
+		t.Fatal(err)
+	}
+	health := app.ModuleHealth(context.Background())
+	if len(health) != 3 || health["reg_kafka"] != nil {
+		t.Fatal("unexpected health:", health)
+	}
+	app.Destroy()
+
+	expect := []string{"init:reg_conf", "init:reg_kafka", "init:reg_http", "close:reg_http", "close:reg_kafka", "close:reg_conf"}
+	if !reflect.DeepEqual(records, expect) {
+		t.Fatal("unexpected lifecycle order:", records)
+	}
+}
+
+type flakyModule struct {
+	name     string
+	failures int32
+	calls    int32
+}
+
+func (m *flakyModule) Name() string {
+	return m.name
+}
+
+func (m *flakyModule) DependsOn() []string {
+	return nil
+}
+
+func (m *flakyModule) Init(ctx context.Context) error {
+	if atomic.AddInt32(&m.calls, 1) <= atomic.LoadInt32(&m.failures) {
+		return errors.New(m.name + " unavailable")
+	}
+	return nil
+}
+
+func (m *flakyModule) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+func (m *flakyModule) Close() error {
+	return nil
+}
+
+func TestModulePolicy(t *testing.T) {
+	lib.ModuleRetryMinInterval = 10 * time.Millisecond
+	lib.RegisterModule(&flakyModule{name: "policy_required_a", failures: 100})
+	lib.RegisterModule(&flakyModule{name: "policy_required_b", failures: 100})
+	lib.RegisterModule(&flakyModule{name: "policy_optional", failures: 100})
+	lib.RegisterModule(&flakyModule{name: "policy_retry", failures: 2})
+	lib.RegisterModule(&flakyModule{name: "policy_ok"})
+	lib.SetModulePolicy("policy_required_a", lib.PolicyRequired)
+	lib.SetModulePolicy("policy_required_b", lib.PolicyRequired)
+	lib.SetModulePolicy("policy_retry", lib.PolicyRetry)
+
+	dir := filepath.Join(t.TempDir(), "dev")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	provider := lib.NewFileProvider(dir)
+	err := lib.InitModuleWithProvider(provider, []string{"policy_ok", "policy_required_a", "policy_required_b"})
+	if err == nil || !strings.Contains(err.Error(), "policy_required_a") || !strings.Contains(err.Error(), "policy_required_b") {
+		t.Fatal("expect aggregated error:", err)
+	}
+	if state := lib.ModuleStates()["policy_ok"].State; state != lib.ModuleStateClosed {
+		t.Fatal("expect started module closed after abort:", state)
+	}
+
+	if err := lib.InitModuleWithProvider(provider, []string{"policy_optional", "policy_retry", "policy_ok"}); err != nil {
+		t.Fatal(err)
+	}
+	defer lib.Destroy()
+	states := lib.ModuleStates()
+	if states["policy_optional"].State != lib.ModuleStateFailed || states["policy_ok"].State != lib.ModuleStateRunning {
+		t.Fatal("unexpected states:", states)
+	}
+	for i := 0; i < 100 && lib.ModuleStates()["policy_retry"].State != lib.ModuleStateRunning; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := lib.ModuleStates()["policy_retry"]; status.State != lib.ModuleStateRunning || status.Attempts != 3 {
+		t.Fatal("retry module not recovered:", status)
+	}
+}
+
+func TestModuleRollback(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dev")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	app := lib.New(lib.WithConfigProvider(lib.NewFileProvider(dir)),
+		lib.WithModule(&flakyModule{name: "rollback_first"}),
+		lib.WithModule(&flakyModule{name: "rollback_second"}),
+		lib.WithModule(&flakyModule{name: "rollback_broken", failures: 100}),
+		lib.WithModulePolicy("rollback_broken", lib.PolicyRequired))
+	defer app.Destroy()
+	if err := app.InitModule([]string{"rollback_first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.InitModule([]string{"rollback_second", "rollback_broken"}); err == nil {
+		t.Fatal("expect required module error")
+	}
+	// 只回滚失败的这次调用启动的模块
+	states := app.ModuleStates()
+	if states["rollback_first"].State != lib.ModuleStateRunning || states["rollback_second"].State != lib.ModuleStateClosed {
+		t.Fatal("unexpected states after rollback:", states)
+	}
+	if health := app.ModuleHealth(context.Background()); len(health) != 1 || health["rollback_first"] != nil {
+		t.Fatal("unexpected health after rollback:", health)
+	}
+}
@@ -0,0 +1,89 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/m17621679833/nice_base/lib"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMysqlGormLoggerConf(t *testing.T) {
+	tmp := t.TempDir()
+	dir := newTestEnv(t, "gorm_logger", map[string]string{
+		"base.toml": fmt.Sprintf(`[base]
+time_location = "UTC"
+[log]
+log_level = "trace"
+[log.file_writer]
+on = true
+log_path = %q
+rotate_log_path = %q
+wf_log_path = %q
+rotate_wf_log_path = %q
+`, filepath.Join(tmp, "inf.log"), filepath.Join(tmp, "inf.log"), filepath.Join(tmp, "wf.log"), filepath.Join(tmp, "wf.log")),
+		"mysql_map.toml": fmt.Sprintf(`[list.loud]
+driver_name = "sqlite"
+data_source_name = %q
+ignore_record_not_found = false
+[list.quiet]
+driver_name = "sqlite"
+data_source_name = %q
+log_level = "warn"
+slow_threshold_ms = 1
+parameterized_queries = true
+`, filepath.Join(tmp, "loud.db"), filepath.Join(tmp, "quiet.db")),
+	})
+	app := newMysqlApp(t, dir)
+	loud, _ := app.GetGormPool("loud")
+	quiet, _ := app.GetGormPool("quiet")
+	loud.Exec("create table lg_user (id integer primary key, name text)")
+	quiet.Exec("create table lg_user (id integer primary key, name text)")
+
+	var user struct {
+		Id   int
+		Name string
+	}
+	if err := loud.Table("lg_user").Where("name = ?", "ghost").First(&user).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatal(err)
+	}
+	loud.Exec("select * from missing_table")
+	loud.Exec("insert into lg_user (name) values (?)", "loud-visible")
+	quiet.Exec("insert into lg_user (name) values (?)", "quiet-secret")
+	var n int
+	quiet.Raw("with recursive c(x) as (select 1 union all select x+1 from c where x < ?) select count(*) from c", 300000).Scan(&n)
+	app.Destroy()
+
+	wf, _ := os.ReadFile(filepath.Join(tmp, "wf.log"))
+	inf, _ := os.ReadFile(filepath.Join(tmp, "inf.log"))
+	var failures, slow []string
+	for _, line := range strings.Split(string(wf), "\n") {
+		switch {
+		case strings.Contains(line, lib.NLTagMySqlFailed):
+			failures = append(failures, line)
+		case strings.Contains(line, lib.NLTagMySqlSlow+"|"):
+			slow = append(slow, line)
+		}
+	}
+	if len(failures) != 2 || !strings.Contains(failures[0], "record not found") || !strings.HasPrefix(failures[0], "[ERROR]") ||
+		!strings.Contains(failures[1], "missing_table") {
+		t.Fatalf("failures in wf log:\n%s", strings.Join(failures, "\n"))
+	}
+	if len(slow) == 0 || !strings.HasPrefix(slow[0], "[WARN") || !strings.Contains(slow[0], "pool=quiet") || !strings.Contains(slow[0], "fingerprint=") {
+		t.Fatalf("slow sql in wf log:\n%s", wf)
+	}
+	if !strings.Contains(string(inf), "loud-visible") {
+		t.Fatal("info level pool should log success sql")
+	}
+	if strings.Contains(string(inf)+string(wf), "quiet-secret") || strings.Contains(string(wf), "x < 300000") {
+		t.Fatalf("parameterized_queries should hide values:\n%s\n%s", inf, wf)
+	}
+	for _, line := range strings.Split(string(inf), "\n") {
+		if strings.Contains(line, lib.NLTagMySqlSuccess) && strings.Contains(line, "pool=quiet") {
+			t.Fatal("warn level pool should not log success sql:", line)
+		}
+	}
+}
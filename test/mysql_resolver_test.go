@@ -0,0 +1,76 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/m17621679833/nice_base/lib"
+	"gorm.io/gorm"
+	"testing"
+)
+
+func TestReplicaPolicy(t *testing.T) {
+	pools := make([]gorm.ConnPool, 3)
+	for i := range pools {
+		db, err := sql.Open("mysql", "root:root@tcp(127.0.0.1:3306)/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		pools[i] = db
+	}
+	index := func(pool gorm.ConnPool) int {
+		for i, p := range pools {
+			if p == pool {
+				return i
+			}
+		}
+		return -1
+	}
+
+	conf := &lib.MysqlConf{
+		ReplicaPolicy: "weighted",
+		Replicas:      []*lib.MysqlReplicaConf{{Weight: 5}, {Weight: 1}, {}},
+	}
+	policy, err := lib.NewReplicaPolicy(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make([]int, len(pools))
+	for i := 0; i < 70; i++ {
+		counts[index(policy.Resolve(pools))]++
+	}
+	if counts[0] != 50 || counts[1] != 10 || counts[2] != 10 {
+		t.Fatal("unexpected weighted distribution:", counts)
+	}
+
+	policy, err = lib.NewReplicaPolicy(&lib.MysqlConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts = make([]int, len(pools))
+	for i := 0; i < 30; i++ {
+		counts[index(policy.Resolve(pools))]++
+	}
+	if counts[0] != 10 || counts[1] != 10 || counts[2] != 10 {
+		t.Fatal("unexpected round robin distribution:", counts)
+	}
+
+	if _, err := lib.NewReplicaPolicy(&lib.MysqlConf{ReplicaPolicy: "fastest"}); err == nil {
+		t.Fatal("expect unknown policy error")
+	}
+
+	dir := newTestEnv(t, "replica", map[string]string{
+		"mysql_map.toml": "[list.default]\ndata_source_name = \"root:root@tcp(10.0.0.1:3306)/gateway\"\nreplica_policy = \"weighted\"\n" +
+			"[[list.default.replicas]]\ndata_source_name = \"root:root@tcp(10.0.0.2:3306)/gateway\"\nweight = 2\n" +
+			"[[list.default.replicas]]\ndata_source_name = \"root:root@tcp(10.0.0.3:3306)/gateway\"\nwieght = 1\n",
+	})
+	snapshot, err := lib.NewFileProvider(dir).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, err := lib.ValidateConfSnapshot(snapshot)
+	if err != nil || len(errs) != 1 || errs[0] != "mysql_map.list.default.replicas[1].wieght: unknown key" {
+		t.Fatal("unexpected validate result:", errs, err)
+	}
+}
@@ -0,0 +1,93 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"github.com/m17621679833/nice_base/lib"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunShutdown(t *testing.T) {
+	var lock sync.Mutex
+	records := []string{}
+	record := func(s string) {
+		lock.Lock()
+		defer lock.Unlock()
+		records = append(records, s)
+	}
+
+	dir := newTestEnv(t, "shutdown", map[string]string{
+		"base.toml": "[base]\ntime_location = \"UTC\"\n[log]\nlog_level = \"info\"\n",
+	})
+	app := lib.New(lib.WithConfigPath(dir))
+	if err := app.InitModule([]string{"base"}); err != nil {
+		t.Fatal(err)
+	}
+	app.OnShutdown("http_server", time.Second, func(ctx context.Context) error {
+		record("http_server")
+		return nil
+	})
+	app.OnShutdown("kafka_consumer", 50*time.Millisecond, func(ctx context.Context) error {
+		record("kafka_consumer")
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	started := make(chan struct{})
+	go func() {
+		<-started
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	err := app.Run(context.Background(), func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		record("run_done")
+		return ctx.Err()
+	})
+
+	var shutdownErr *lib.ShutdownError
+	if !errors.As(err, &shutdownErr) {
+		t.Fatal("expect ShutdownError:", err)
+	}
+	if !reflect.DeepEqual(shutdownErr.TimedOut, []string{"kafka_consumer"}) {
+		t.Fatal("unexpected timed out hooks:", shutdownErr.TimedOut)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(records, []string{"run_done", "kafka_consumer", "http_server"}) {
+		t.Fatal("unexpected shutdown order:", records)
+	}
+	if state := app.ModuleStates()["base"].State; state != lib.ModuleStateClosed {
+		t.Fatal("base module not closed:", state)
+	}
+}
+
+// InitModule前后注册的钩子都在模块关闭前执行
+func TestShutdownHookOrder(t *testing.T) {
+	records := []string{}
+	app := lib.New(lib.WithConfigProvider(lib.NewFileProvider(newTestEnv(t, "shutdown_order", nil))))
+	app.RegisterModule(&recordModule{name: "sd_db", records: &records})
+	app.OnShutdown("early", time.Second, func(ctx context.Context) error {
+		records = append(records, "hook:early")
+		return nil
+	})
+	if err := app.InitModule([]string{"sd_db"}); err != nil {
+		t.Fatal(err)
+	}
+	app.OnShutdown("late", time.Second, func(ctx context.Context) error {
+		records = append(records, "hook:late")
+		return nil
+	})
+	if err := app.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"init:sd_db", "hook:late", "hook:early", "close:sd_db"}
+	if !reflect.DeepEqual(records, expect) {
+		t.Fatal("unexpected shutdown order:", records)
+	}
+}